@@ -0,0 +1,479 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rlmcpherson/s3gof3r"
+)
+
+type s3Object struct {
+	Key  string `xml:"Key"`
+	Size int64  `xml:"Size"`
+	ETag string `xml:"ETag"`
+}
+
+type listBucketResult struct {
+	Contents    []s3Object `xml:"Contents"`
+	IsTruncated bool       `xml:"IsTruncated"`
+	NextMarker  string     `xml:"NextMarker"`
+}
+
+// listObjects lists every object in the bucket under prefix, a page at a
+// time with the original ListObjects API, which S3-compatible services
+// support more widely than ListObjectsV2.
+func listObjects(bucket *s3gof3r.Bucket, prefix string) ([]s3Object, error) {
+	var objects []s3Object
+	marker := ""
+	for {
+		u := bucketObjectURL(bucket, "")
+		q := url.Values{}
+		if prefix != "" {
+			q.Set("prefix", prefix)
+		}
+		if marker != "" {
+			q.Set("marker", marker)
+		}
+		u.RawQuery = q.Encode()
+
+		req, err := http.NewRequest("GET", u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		bucket.Sign(req)
+		resp, err := bucket.Config.Client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		var page listBucketResult
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, errors.New(fmt.Sprintf("listing %v returned %v", bucket.Name, resp.Status))
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		objects = append(objects, page.Contents...)
+		if !page.IsTruncated || len(page.Contents) == 0 {
+			return objects, nil
+		}
+		marker = page.NextMarker
+		if marker == "" {
+			marker = page.Contents[len(page.Contents)-1].Key
+		}
+	}
+}
+
+// keyPattern matches the keys fillKeyTemplate makes from t for r, capturing
+// the hash. Sliced placeholders like {hash[0:2]} match anything, and are
+// checked by making the key again from the hash.
+func keyPattern(t string, r rendition) *regexp.Regexp {
+	var pattern string
+	last := 0
+	for _, loc := range keyPlaceholder.FindAllStringSubmatchIndex(t, -1) {
+		pattern += regexp.QuoteMeta(t[last:loc[0]])
+		last = loc[1]
+		name := t[loc[2]:loc[3]]
+		sliced := loc[4] != -1
+		switch {
+		case name == "hash" && !sliced:
+			pattern += `(?P<hash>[0-9a-f]{32})`
+		case name == "hash":
+			pattern += `[0-9a-f]*`
+		case name == "rendition":
+			pattern += regexp.QuoteMeta(r.Name)
+		case name == "ext":
+			pattern += regexp.QuoteMeta(r.Extension)
+		}
+	}
+	pattern += regexp.QuoteMeta(t[last:])
+	return regexp.MustCompile("^" + pattern + "$")
+}
+
+func keyPatterns() []*regexp.Regexp {
+	patterns := make([]*regexp.Regexp, len(renditions))
+	for i, r := range renditions {
+		patterns[i] = keyPattern(config.S3.KeyTemplate, r)
+	}
+	return patterns
+}
+
+// parseObjectKey works out which hash and rendition key belongs to, using
+// the keyPatterns for each rendition.
+func parseObjectKey(patterns []*regexp.Regexp, key string) (string, rendition, bool) {
+	for i, r := range renditions {
+		m := patterns[i].FindStringSubmatch(key)
+		if m == nil || len(m) < 2 {
+			continue
+		}
+		if hash := m[1]; objectKey(hash, r) == key {
+			return hash, r, true
+		}
+	}
+	return "", rendition{}, false
+}
+
+type AuditObject struct {
+	Key                 string `json:"key"`
+	ContentType         string `json:"content_type"`
+	ExpectedContentType string `json:"expected_content_type"`
+}
+
+type AuditHash struct {
+	Hash      string   `json:"hash"`
+	SourceURL string   `json:"source_url,omitempty"`
+	Keys      []string `json:"keys"`
+	Missing   []string `json:"missing,omitempty"`
+	Removed   bool     `json:"removed,omitempty"`
+}
+
+type AuditResult struct {
+	Objects          int           `json:"objects"`
+	Hashes           int           `json:"hashes"`
+	Incomplete       []AuditHash   `json:"incomplete"`
+	WrongContentType []AuditObject `json:"wrong_content_type"`
+	NotInStore       []AuditHash   `json:"not_in_store"`
+	Unrecognised     []string      `json:"unrecognised"`
+	Adopted          []string      `json:"adopted,omitempty"`
+	Unidentified     []string      `json:"unidentified,omitempty"`
+	Repaired         []string      `json:"repaired,omitempty"`
+	Deleted          []string      `json:"deleted,omitempty"`
+}
+
+// auditCommand lists the bucket and reports sets of renditions with some
+// missing, objects with the wrong Content-Type and hashes the metadata store
+// doesn't know about. With -repair, broken sets that are in the store are
+// converted again. With -delete, sets that aren't in the store are adopted
+// into it when their metadata says which url they came from, and otherwise
+// deleted, unless there's nothing to say what they are. The report is
+// printed on stdout.
+func auditCommand(args []string) error {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	prefix := flags.String("prefix", "", "only audit keys starting with this")
+	concurrency := flags.Int("concurrency", 8, "how many objects to check at once")
+	repair := flags.Bool("repair", false, "convert incomplete sets and ones with the wrong Content-Type again, when they're in the metadata store")
+	del := flags.Bool("delete", false, "adopt or delete the objects of hashes that aren't in the metadata store")
+	confirm := flags.Bool("confirm", false, "confirm -delete")
+	c, err := loadConfig(flags, args)
+	if err != nil {
+		return err
+	}
+	if err := c.validate(true); err != nil {
+		return err
+	}
+	if *del && !*confirm {
+		return errors.New("-delete deletes objects the metadata store doesn't know about, so it has to be run with -confirm; check a report without it first")
+	}
+	if *concurrency < 1 {
+		return errors.New(fmt.Sprintf("-concurrency must be at least 1, got %d", *concurrency))
+	}
+	useConfig(c)
+	logOutput = os.Stderr
+
+	if err := os.MkdirAll(config.Scratch.Dir, 0755); err != nil {
+		return err
+	}
+	store, err = openSharedStore()
+	if err != nil {
+		return err
+	}
+	if err := syncStore(rootLogger); err != nil {
+		return err
+	}
+	bucket, err := newBucket()
+	if err != nil {
+		return err
+	}
+
+	rootLogger.info("listing bucket", "bucket", config.S3.BucketName, "prefix", *prefix)
+	objects, err := listObjects(bucket, *prefix)
+	if err != nil {
+		return err
+	}
+	result := AuditResult{Objects: len(objects)}
+
+	patterns := keyPatterns()
+	archiveBucketName, _ := config.S3.archiveBucket()
+	archivePattern := keyPattern(config.S3.Archive.KeyTemplate, originalRendition)
+	sets := map[string]map[string]string{}
+	tombstoned := map[string]bool{}
+	for _, o := range objects {
+		if strings.HasPrefix(o.Key, config.S3.TombstonePrefix) {
+			tombstoned[strings.TrimPrefix(o.Key, config.S3.TombstonePrefix)] = true
+			continue
+		}
+		if strings.HasPrefix(o.Key, config.S3.RecordPrefix) {
+			continue
+		}
+		if strings.HasPrefix(o.Key, ".md5/") || o.Key == config.Index.Key {
+			continue
+		}
+		if archiveBucketName == config.S3.BucketName && archivePattern.MatchString(o.Key) {
+			continue
+		}
+		hash, r, ok := parseObjectKey(patterns, o.Key)
+		if !ok {
+			result.Unrecognised = append(result.Unrecognised, o.Key)
+			continue
+		}
+		if sets[hash] == nil {
+			sets[hash] = map[string]string{}
+		}
+		sets[hash][r.Extension] = o.Key
+	}
+	result.Hashes = len(sets)
+	rootLogger.info("checking objects", "objects", len(objects), "hashes", len(sets))
+
+	wrongContentType, err := checkContentTypes(bucket, sets, *concurrency)
+	if err != nil {
+		return err
+	}
+	result.WrongContentType = wrongContentType
+	broken := map[string]bool{}
+	for _, o := range wrongContentType {
+		hash, _, _ := parseObjectKey(patterns, o.Key)
+		broken[hash] = true
+	}
+
+	hashes := make([]string, 0, len(sets))
+	for hash := range sets {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	var orphans []AuditHash
+	for _, hash := range hashes {
+		set := AuditHash{Hash: hash}
+		for _, r := range renditions {
+			if key, ok := sets[hash][r.Extension]; ok {
+				set.Keys = append(set.Keys, key)
+			} else {
+				set.Missing = append(set.Missing, r.Extension)
+			}
+		}
+		c, inStore := store.conversion(hash)
+		if inStore {
+			set.SourceURL = c.SourceURL
+		} else if t, ok := store.tombstone(hash); ok {
+			set.SourceURL, set.Removed = t.SourceURL, true
+		}
+		if tombstoned[hash] {
+			set.Removed = true
+		}
+
+		if len(set.Missing) > 0 {
+			result.Incomplete = append(result.Incomplete, set)
+			broken[hash] = true
+		}
+		if !inStore {
+			result.NotInStore = append(result.NotInStore, set)
+			orphans = append(orphans, set)
+		}
+	}
+
+	// Adopt first, so the sets that are adopted can be repaired.
+	var doomed []AuditHash
+	if *del {
+		for _, set := range orphans {
+			if set.Removed {
+				doomed = append(doomed, set)
+				continue
+			}
+			adopted, err := adopt(bucket, set)
+			if err != nil {
+				return err
+			}
+			switch adopted {
+			case adoptedSet:
+				result.Adopted = append(result.Adopted, set.Hash)
+			case unidentifiedSet:
+				result.Unidentified = append(result.Unidentified, set.Hash)
+			case foreignSet:
+				doomed = append(doomed, set)
+			}
+		}
+	}
+
+	if *repair {
+		for _, hash := range hashes {
+			c, ok := store.conversion(hash)
+			if !broken[hash] || !ok {
+				continue
+			}
+			// The listing only has the tombstones under -prefix, so ask.
+			if _, removed, err := findTombstone(hash); err != nil {
+				return err
+			} else if removed {
+				continue
+			}
+			rootLogger.info("repairing", "hash", hash, "url", c.SourceURL)
+			if err := reencode(reencodeJob{Hash: hash, SourceURL: c.SourceURL}, reencodeCacheControl); err != nil {
+				rootLogger.error("repairing failed", "hash", hash, "url", c.SourceURL, "error", err)
+				continue
+			}
+			result.Repaired = append(result.Repaired, hash)
+		}
+	}
+	if *del {
+		for _, set := range doomed {
+			for _, key := range set.Keys {
+				rootLogger.info("deleting", "hash", set.Hash, "key", key)
+				if err := deleteFromS3(key); err != nil {
+					return err
+				}
+				result.Deleted = append(result.Deleted, key)
+			}
+		}
+	}
+
+	rootLogger.info("audited",
+		"objects", result.Objects,
+		"hashes", result.Hashes,
+		"incomplete", len(result.Incomplete),
+		"wrong_content_type", len(result.WrongContentType),
+		"not_in_store", len(result.NotInStore),
+		"unrecognised", len(result.Unrecognised),
+		"adopted", len(result.Adopted),
+		"unidentified", len(result.Unidentified),
+		"repaired", len(result.Repaired),
+		"deleted", len(result.Deleted))
+
+	js, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", js)
+	return nil
+}
+
+type adoption int
+
+const (
+	adoptedSet adoption = iota
+	unidentifiedSet
+	foreignSet
+)
+
+// adopt records set in the metadata store when its x-amz-meta-source-url
+// hashes to its hash, which is the case for objects uploaded before the store
+// existed or by a server with another store. Sets without the metadata are
+// unidentified, and ones whose source url doesn't match don't belong here.
+func adopt(bucket *s3gof3r.Bucket, set AuditHash) (adoption, error) {
+	if len(set.Keys) == 0 {
+		return unidentifiedSet, nil
+	}
+	resp, err := headObject(bucket, set.Keys[0])
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, errors.New(fmt.Sprintf("HEAD %v returned %v", set.Keys[0], resp.Status))
+	}
+	sourceURL := resp.Header.Get("x-amz-meta-source-url")
+	if sourceURL == "" {
+		rootLogger.warn("not deleting a set with no source url", "hash", set.Hash, "key", set.Keys[0])
+		return unidentifiedSet, nil
+	}
+	if urlHash(sourceURL) != set.Hash {
+		return foreignSet, nil
+	}
+
+	width, _ := strconv.Atoi(resp.Header.Get("x-amz-meta-width"))
+	height, _ := strconv.Atoi(resp.Header.Get("x-amz-meta-height"))
+	keys := map[string]string{}
+	for _, key := range set.Keys {
+		if _, r, ok := parseObjectKey(keyPatterns(), key); ok {
+			keys[r.Extension] = key
+		}
+	}
+	url := func(extension string) string {
+		if key, ok := keys[extension]; ok {
+			return objectURL(key)
+		}
+		return ""
+	}
+	rootLogger.info("adopting", "hash", set.Hash, "url", sourceURL)
+	err = store.recordConversion(conversion{
+		Hash:      set.Hash,
+		SourceURL: sourceURL,
+		Keys:      keys,
+		Result: UploadResult{
+			MP4URL:          url("mp4"),
+			WEBMURL:         url("webm"),
+			PNGURL:          url("jpg"),
+			OptimizedGIFURL: url("gif"),
+			Width:           width,
+			Height:          height,
+		},
+		CreatedAt: time.Now().UTC(),
+	})
+	return adoptedSet, err
+}
+
+// checkContentTypes HEADs every object in sets, at most concurrency at a
+// time, and returns the ones whose Content-Type isn't their rendition's.
+func checkContentTypes(bucket *s3gof3r.Bucket, sets map[string]map[string]string, concurrency int) ([]AuditObject, error) {
+	type check struct {
+		key      string
+		expected string
+	}
+	checks := make(chan check)
+	var mu sync.Mutex
+	var wrong []AuditObject
+	var firstErr error
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range checks {
+				resp, err := headObject(bucket, c.key)
+				if err == nil && resp.StatusCode != http.StatusOK {
+					err = errors.New(fmt.Sprintf("HEAD %v returned %v", c.key, resp.Status))
+				}
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				} else if err == nil && resp.Header.Get("Content-Type") != c.expected {
+					wrong = append(wrong, AuditObject{
+						Key:                 c.key,
+						ContentType:         resp.Header.Get("Content-Type"),
+						ExpectedContentType: c.expected,
+					})
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, set := range sets {
+		for extension, key := range set {
+			r, _ := renditionForExtension(extension)
+			checks <- check{key, r.ContentType}
+		}
+	}
+	close(checks)
+	wg.Wait()
+
+	sort.Sort(byKey(wrong))
+	return wrong, firstErr
+}
+
+type byKey []AuditObject
+
+func (a byKey) Len() int           { return len(a) }
+func (a byKey) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byKey) Less(i, j int) bool { return a[i].Key < a[j].Key }
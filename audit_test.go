@@ -0,0 +1,84 @@
+package main
+
+import "testing"
+
+// withKeyTemplate sets s3.key_template and the renditions for a test, and
+// returns a function that puts them back.
+func withKeyTemplate(template string, rs []rendition) func() {
+	oldTemplate, oldRenditions := config.S3.KeyTemplate, renditions
+	config.S3.KeyTemplate, renditions = template, rs
+	return func() {
+		config.S3.KeyTemplate, renditions = oldTemplate, oldRenditions
+	}
+}
+
+func TestKeyPattern(t *testing.T) {
+	webm := baseRenditions[0]
+	tests := []struct {
+		template string
+		key      string
+		matches  bool
+	}{
+		{"{hash}.{ext}", testHash + ".webm", true},
+		{"{hash}.{ext}", testHash + ".mp4", false},
+		{"{hash}.{ext}", testHash + "xwebm", false},
+		{"{hash}.{ext}", "ffbb.webm", false},
+		{"{hash}.{ext}", "x" + testHash + ".webm", false},
+		{"{hash}.{ext}", testHash + ".webm.bak", false},
+		{"{hash}.{ext}", "FFBBCC7FB8ACACA2E3839414BC3A61BD.webm", false},
+		{"gifs/{hash[0:2]}/{hash}/{rendition}.{ext}", "gifs/ff/" + testHash + "/video.webm", true},
+		{"gifs/{hash[0:2]}/{hash}/{rendition}.{ext}", "gifs/aa/" + testHash + "/video.webm", true},
+		{"gifs/{hash[0:2]}/{hash}/{rendition}.{ext}", "gifs/ff/" + testHash + "/poster.webm", false},
+		{"gifs+{hash}.{ext}", "gifs+" + testHash + ".webm", true},
+		{"gifs+{hash}.{ext}", "gifss" + testHash + ".webm", false},
+	}
+	for _, test := range tests {
+		m := keyPattern(test.template, webm).FindStringSubmatch(test.key)
+		if got := m != nil; got != test.matches {
+			t.Errorf("keyPattern(%q) matches %q = %v, want %v", test.template, test.key, got, test.matches)
+			continue
+		}
+		if m != nil && m[1] != testHash {
+			t.Errorf("keyPattern(%q) of %q captures %q, want %q", test.template, test.key, m[1], testHash)
+		}
+	}
+}
+
+func TestParseObjectKey(t *testing.T) {
+	defer withKeyTemplate("gifs/{hash[0:2]}/{hash}/{rendition}.{ext}", allTestRenditions)()
+	patterns := keyPatterns()
+
+	for _, r := range allTestRenditions {
+		key := objectKey(testHash, r)
+		hash, got, ok := parseObjectKey(patterns, key)
+		if !ok || hash != testHash || got != r {
+			t.Errorf("parseObjectKey(%q) = %q, %v, %v, want %q, %v", key, hash, got.Extension, ok, testHash, r.Extension)
+		}
+	}
+
+	for _, key := range []string{
+		"gifs/aa/" + testHash + "/video.webm",
+		"gifs/ff/" + testHash + "/gif.webm",
+		"gifs/ff/" + testHash + "/video.mov",
+		"gifs/ff/" + testHash + "/original.gif",
+		testHash + ".webm",
+		".tombstones/" + testHash,
+		"",
+	} {
+		if hash, r, ok := parseObjectKey(patterns, key); ok {
+			t.Errorf("parseObjectKey(%q) = %q, %v, want it unrecognised", key, hash, r.Extension)
+		}
+	}
+}
+
+func TestParseObjectKeyWithoutGIFs(t *testing.T) {
+	defer withKeyTemplate("{hash}.{ext}", baseRenditions)()
+	patterns := keyPatterns()
+
+	if _, r, ok := parseObjectKey(patterns, testHash+".mp4"); !ok || r != baseRenditions[1] {
+		t.Errorf("parseObjectKey() of an mp4 = %v, %v, want the mp4 rendition", r.Extension, ok)
+	}
+	if _, _, ok := parseObjectKey(patterns, testHash+".gif"); ok {
+		t.Error("parseObjectKey() of a gif = ok, want it unrecognised without gif.enabled")
+	}
+}
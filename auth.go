@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AndrewVos/ancientcitadelgifs/signature"
+)
+
+type apiKey struct {
+	Key        string `json:"key"`
+	Name       string `json:"name"`
+	RateLimit  int    `json:"rate_limit"`
+	DailyQuota int    `json:"daily_quota"`
+}
+
+// apiClient tracks the usage of one api key. RateLimit is enforced as a
+// token bucket holding up to a minute's worth of requests, and DailyQuota
+// resets at midnight UTC. Zero means unlimited for both. The counts are
+// only kept in memory, so each process has its own, starting from
+// countedSince.
+type apiClient struct {
+	apiKey
+
+	countedSince     time.Time
+	mu               sync.Mutex
+	tokens           float64
+	refilledAt       time.Time
+	day              string
+	conversionsToday int
+	requests         int64
+	rateLimited      int64
+	quotaExceeded    int64
+}
+
+type ClientUsage struct {
+	Name             string    `json:"name"`
+	RateLimit        int       `json:"rate_limit"`
+	DailyQuota       int       `json:"daily_quota"`
+	ConversionsToday int       `json:"conversions_today"`
+	Requests         int64     `json:"requests"`
+	RateLimited      int64     `json:"rate_limited"`
+	QuotaExceeded    int64     `json:"quota_exceeded"`
+	CountedSince     time.Time `json:"counted_since"`
+}
+
+var apiClients map[string]*apiClient
+
+func loadAPIKeys(path string) (map[string]*apiClient, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []apiKey
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return nil, errors.New(fmt.Sprintf("%v: %v", path, err))
+	}
+
+	clients := map[string]*apiClient{}
+	for i, k := range keys {
+		if k.Key == "" || k.Name == "" {
+			return nil, errors.New(fmt.Sprintf("%v: key %d needs a key and a name", path, i))
+		}
+		if k.RateLimit < 0 || k.DailyQuota < 0 {
+			return nil, errors.New(fmt.Sprintf("%v: %q has a negative limit", path, k.Name))
+		}
+		if _, ok := clients[k.Key]; ok {
+			return nil, errors.New(fmt.Sprintf("%v: %q reuses another client's key", path, k.Name))
+		}
+		now := time.Now()
+		clients[k.Key] = &apiClient{apiKey: k, countedSince: now.UTC(), tokens: float64(k.RateLimit), refilledAt: now}
+	}
+	return clients, nil
+}
+
+// requireAdmin checks for "Authorization: Bearer $ADMIN_TOKEN", serving an
+// error and returning false if it's missing or wrong.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if config.AdminToken == "" {
+		serveErrorStatus(w, r, "the admin api is disabled, set ADMIN_TOKEN to enable it", http.StatusForbidden)
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) != 1 {
+		serveErrorStatus(w, r, "invalid admin token", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// requireSignature checks the request was signed with URL_SIGNING_SECRET,
+// when it's set, serving a 403 and returning false if it wasn't.
+func requireSignature(w http.ResponseWriter, r *http.Request) bool {
+	if config.URLSigningSecret == "" {
+		return true
+	}
+	err := signature.Verify([]byte(config.URLSigningSecret), r.URL.Path, r.URL.Query(), time.Now())
+	if err != nil {
+		serveErrorStatus(w, r, err.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// authenticateClient finds the client for the X-Api-Key header or the
+// api_key query parameter, and charges it for the given number of
+// conversions. It serves a 401 or 429 and returns false if the request
+// shouldn't go ahead. When no keys are configured every request is let
+// through with a nil client. Conversions that don't happen have to be
+// given back with refund.
+func authenticateClient(w http.ResponseWriter, r *http.Request, conversions int) (*apiClient, bool) {
+	if apiClients == nil {
+		return nil, true
+	}
+	key := r.Header.Get("X-Api-Key")
+	if key == "" {
+		key = r.URL.Query().Get("api_key")
+	}
+	var client *apiClient
+	for k, c := range apiClients {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+			client = c
+		}
+	}
+	if client == nil {
+		serveErrorStatus(w, r, "a valid api key is required", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	retryAfter, err := client.take(time.Now().UTC(), conversions)
+	if err != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		serveErrorStatus(w, r, err.Error(), http.StatusTooManyRequests)
+		return nil, false
+	}
+	return client, true
+}
+
+func (c *apiClient) take(now time.Time, conversions int) (time.Duration, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests++
+
+	if c.RateLimit > 0 {
+		perSecond := float64(c.RateLimit) / 60
+		c.tokens = math.Min(float64(c.RateLimit), c.tokens+now.Sub(c.refilledAt).Seconds()*perSecond)
+		c.refilledAt = now
+		if c.tokens < 1 {
+			c.rateLimited++
+			wait := time.Duration((1 - c.tokens) / perSecond * float64(time.Second))
+			return wait, errors.New(fmt.Sprintf("rate limit of %d requests a minute exceeded", c.RateLimit))
+		}
+	}
+
+	day := now.Format("2006-01-02")
+	if day != c.day {
+		c.day = day
+		c.conversionsToday = 0
+	}
+	if c.DailyQuota > 0 && c.conversionsToday+conversions > c.DailyQuota {
+		c.quotaExceeded++
+		tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+		return tomorrow.Sub(now), errors.New(fmt.Sprintf("daily quota of %d conversions exceeded", c.DailyQuota))
+	}
+
+	if c.RateLimit > 0 {
+		c.tokens--
+	}
+	c.conversionsToday += conversions
+	return 0, nil
+}
+
+// refund gives back conversions that were charged for but failed or never
+// started, so only successful conversions count towards the daily quota.
+// The request still counts towards the rate limit.
+func (c *apiClient) refund(conversions int) {
+	if c == nil || conversions == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.day != time.Now().UTC().Format("2006-01-02") {
+		return
+	}
+	c.conversionsToday -= conversions
+	if c.conversionsToday < 0 {
+		c.conversionsToday = 0
+	}
+}
+
+func (c *apiClient) usage() ClientUsage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	u := ClientUsage{
+		Name:          c.Name,
+		RateLimit:     c.RateLimit,
+		DailyQuota:    c.DailyQuota,
+		Requests:      c.requests,
+		RateLimited:   c.rateLimited,
+		QuotaExceeded: c.quotaExceeded,
+		CountedSince:  c.countedSince,
+	}
+	if c.day == time.Now().UTC().Format("2006-01-02") {
+		u.ConversionsToday = c.conversionsToday
+	}
+	return u
+}
+
+// usageHandler serves the usage of every key as counted by this process
+// alone, since counted_since. Other processes, and other apps sharing the
+// keys, have their own counts.
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	usage := []ClientUsage{}
+	for _, c := range apiClients {
+		usage = append(usage, c.usage())
+	}
+	sort.Sort(byName(usage))
+
+	js, err := json.Marshal(usage)
+	if err != nil {
+		serveError(w, r, err.Error())
+		return
+	}
+	w.Write(js)
+}
+
+type byName []ClientUsage
+
+func (u byName) Len() int           { return len(u) }
+func (u byName) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
+func (u byName) Less(i, j int) bool { return u[i].Name < u[j].Name }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestClient(rateLimit, dailyQuota int, now time.Time) *apiClient {
+	k := apiKey{Key: "key", Name: "test", RateLimit: rateLimit, DailyQuota: dailyQuota}
+	return &apiClient{apiKey: k, countedSince: now, tokens: float64(rateLimit), refilledAt: now}
+}
+
+func TestTakeRateLimit(t *testing.T) {
+	now := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	c := newTestClient(60, 0, now)
+
+	for i := 0; i < 60; i++ {
+		if _, err := c.take(now, 1); err != nil {
+			t.Fatalf("take() %d = %v, want nil", i, err)
+		}
+	}
+	wait, err := c.take(now, 1)
+	if err == nil {
+		t.Fatal("take() over the rate limit = nil, want an error")
+	}
+	if wait != time.Second {
+		t.Errorf("take() over the rate limit waits %v, want 1s", wait)
+	}
+
+	// A token a second comes back, up to a minute's worth.
+	if _, err := c.take(now.Add(time.Second), 1); err != nil {
+		t.Errorf("take() a second later = %v, want nil", err)
+	}
+	if _, err := c.take(now.Add(time.Second), 1); err == nil {
+		t.Error("take() twice a second later = nil, want an error")
+	}
+	later := now.Add(time.Hour)
+	for i := 0; i < 60; i++ {
+		if _, err := c.take(later, 1); err != nil {
+			t.Fatalf("take() %d an hour later = %v, want nil", i, err)
+		}
+	}
+	if _, err := c.take(later, 1); err == nil {
+		t.Error("take() an hour later = nil, want the bucket to hold only a minute's worth")
+	}
+
+	if u := c.usage(); u.Requests != 124 || u.RateLimited != 3 {
+		t.Errorf("usage() = %d requests, %d rate limited, want 124 and 3", u.Requests, u.RateLimited)
+	}
+}
+
+func TestTakeDailyQuota(t *testing.T) {
+	now := time.Date(2015, 6, 1, 18, 0, 0, 0, time.UTC)
+	c := newTestClient(0, 10, now)
+
+	if _, err := c.take(now, 8); err != nil {
+		t.Fatalf("take(8) = %v, want nil", err)
+	}
+	wait, err := c.take(now, 3)
+	if err == nil {
+		t.Fatal("take(3) over the quota = nil, want an error")
+	}
+	if wait != 6*time.Hour {
+		t.Errorf("take(3) over the quota waits %v, want until midnight", wait)
+	}
+	if _, err := c.take(now, 2); err != nil {
+		t.Errorf("take(2) up to the quota = %v, want nil", err)
+	}
+	if _, err := c.take(now, 1); err == nil {
+		t.Error("take(1) over the quota = nil, want an error")
+	}
+
+	tomorrow := time.Date(2015, 6, 2, 0, 0, 1, 0, time.UTC)
+	if _, err := c.take(tomorrow, 10); err != nil {
+		t.Errorf("take(10) the next day = %v, want the quota reset", err)
+	}
+	if c.conversionsToday != 10 || c.quotaExceeded != 2 {
+		t.Errorf("%d conversions today, %d over quota, want 10 and 2", c.conversionsToday, c.quotaExceeded)
+	}
+}
+
+func TestTakeRateLimitedDoesNotCountConversions(t *testing.T) {
+	now := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	c := newTestClient(1, 10, now)
+
+	if _, err := c.take(now, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.take(now, 1); err == nil {
+		t.Fatal("take() over the rate limit = nil, want an error")
+	}
+	if c.conversionsToday != 1 {
+		t.Errorf("%d conversions today, want 1", c.conversionsToday)
+	}
+}
+
+func TestRefund(t *testing.T) {
+	now := time.Now().UTC()
+	c := newTestClient(0, 10, now)
+	if _, err := c.take(now, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	c.refund(3)
+	if _, err := c.take(now, 3); err != nil {
+		t.Errorf("take(3) after a refund = %v, want nil", err)
+	}
+	c.refund(20)
+	if c.conversionsToday != 0 {
+		t.Errorf("%d conversions today after refunding too many, want 0", c.conversionsToday)
+	}
+	if u := c.usage(); u.ConversionsToday != 0 || u.Requests != 2 {
+		t.Errorf("usage() = %d conversions, %d requests, want 0 and 2", u.ConversionsToday, u.Requests)
+	}
+
+	// A refund for a conversion charged on another day is ignored, since
+	// that day's quota has already reset.
+	yesterday := now.Add(-24 * time.Hour)
+	c = newTestClient(0, 10, yesterday)
+	if _, err := c.take(yesterday, 5); err != nil {
+		t.Fatal(err)
+	}
+	c.refund(5)
+	if c.conversionsToday != 5 || c.day != yesterday.Format("2006-01-02") {
+		t.Errorf("%d conversions on %v after a refund from another day, want it left alone", c.conversionsToday, c.day)
+	}
+
+	var anonymous *apiClient
+	anonymous.refund(1)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/AndrewVos/ancientcitadelgifs/signature"
+)
+
+// batchItem is either a bare url, or an object with the url and the same
+// options /upload takes.
+type batchItem struct {
+	URL      string `json:"url"`
+	Callback string `json:"callback"`
+}
+
+func (item *batchItem) UnmarshalJSON(b []byte) error {
+	var u string
+	if err := json.Unmarshal(b, &u); err == nil {
+		item.URL = u
+		return nil
+	}
+	type plain batchItem
+	return json.Unmarshal(b, (*plain)(item))
+}
+
+type BatchResult struct {
+	Index  int           `json:"index"`
+	URL    string        `json:"url"`
+	Result *UploadResult `json:"result,omitempty"`
+	Error  string        `json:"error,omitempty"`
+	Status int           `json:"status"`
+}
+
+func runBatchItem(log *logger, index int, item batchItem) BatchResult {
+	result := BatchResult{Index: index, URL: item.URL}
+	err := func() error {
+		if item.URL == "" {
+			return errors.New("please specify a file to download")
+		}
+		if item.Callback != "" {
+			if err := checkCallbackURL(item.Callback); err != nil {
+				return err
+			}
+		}
+		if err := checkGIFURL(item.URL); err != nil {
+			return err
+		}
+		uploadResult, err := convertGIF(log, item.URL, nil)
+		if item.Callback != "" {
+			goBackground(func() {
+				deliverCallback(log, item.Callback, item.URL, uploadResult, err)
+			})
+		}
+		if err != nil {
+			return err
+		}
+		result.Result = &uploadResult
+		return nil
+	}()
+	if err != nil {
+		result.Error = err.Error()
+		result.Status = errorStatus(err)
+	} else {
+		result.Status = http.StatusOK
+	}
+	return result
+}
+
+// batchHandler converts every url in the posted JSON array, at most
+// BATCH_CONCURRENCY at a time. The results are returned together in the
+// order they were given, or with ?stream=true written as NDJSON as each one
+// finishes.
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	log := requestLogger(r)
+	w.Header().Set("Content-Type", "application/json")
+	if !requireSignature(w, r) {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		serveErrorStatus(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// The signature only covers the url, so a signed batch url carries the
+	// hash of its body as well.
+	if config.URLSigningSecret != "" {
+		if err := signature.VerifyBody(r.URL.Query(), body); err != nil {
+			serveErrorStatus(w, r, "the body doesn't match the signed url: "+err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	var items []batchItem
+	err = json.Unmarshal(body, &items)
+	if err != nil {
+		serveErrorStatus(w, r, "please post a JSON array of urls: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(items) == 0 || len(items) > config.Batch.MaxSize {
+		serveErrorStatus(w, r, fmt.Sprintf("a batch needs between 1 and %d urls", config.Batch.MaxSize), http.StatusBadRequest)
+		return
+	}
+	client, ok := authenticateClient(w, r, len(items))
+	if !ok {
+		return
+	}
+
+	stream := r.URL.Query().Get("stream") == "true"
+	flusher, _ := w.(http.Flusher)
+	if stream {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+
+	results := make([]BatchResult, len(items))
+	finished := make(chan BatchResult)
+	slots := make(chan struct{}, config.Batch.Concurrency)
+	var wg sync.WaitGroup
+	for i, item := range items {
+		wg.Add(1)
+		go func(i int, item batchItem) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			finished <- runBatchItem(log.with("batch_item", i), i, item)
+		}(i, item)
+	}
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	encoder := json.NewEncoder(w)
+	for result := range finished {
+		if result.Error != "" {
+			client.refund(1)
+		}
+		results[result.Index] = result
+		if stream {
+			encoder.Encode(result)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	if !stream {
+		encoder.Encode(results)
+	}
+}
@@ -0,0 +1,665 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds every setting. Each one can be set in the JSON config file,
+// then overridden by an environment variable named after its path (so
+// s3.bucket_name is S3_BUCKET_NAME), and then by a flag (-s3-bucket-name).
+type Config struct {
+	Port                 string   `json:"port" usage:"the port to bind to"`
+	MetadataPath         string   `json:"metadata_path" usage:"the JSON file conversions and deletions are recorded in"`
+	MetadataSyncInterval duration `json:"metadata_sync_interval" usage:"how often to copy conversions other servers made from the bucket, or 0 for only at startup"`
+	MaxConcurrentJobs    int      `json:"max_concurrent_jobs" usage:"how many conversions can run at once"`
+	FFmpegPath           string   `json:"ffmpeg_path" usage:"the ffmpeg binary, as a path or a name to look up in PATH"`
+	ConvertPath          string   `json:"convert_path" usage:"ImageMagick's convert binary, as a path or a name to look up in PATH"`
+	APIKeysPath          string   `json:"api_keys_path" usage:"a JSON file of api keys; without one /upload is open to everyone"`
+	AdminToken           string   `json:"admin_token" secret:"true" usage:"the bearer token for the admin endpoints"`
+	URLSigningSecret     string   `json:"url_signing_secret" secret:"true" usage:"when set, requests must be signed with it"`
+
+	Scratch  ScratchConfig  `json:"scratch"`
+	Log      LogConfig      `json:"log"`
+	Source   SourceConfig   `json:"source"`
+	Batch    BatchConfig    `json:"batch"`
+	Download DownloadConfig `json:"download"`
+	Webhook  WebhookConfig  `json:"webhook"`
+	Shutdown ShutdownConfig `json:"shutdown"`
+	Index    IndexConfig    `json:"index"`
+	GIF      GIFConfig      `json:"gif"`
+	S3       S3Config       `json:"s3"`
+	AWS      AWSConfig      `json:"aws"`
+}
+
+type ScratchConfig struct {
+	Dir       string `json:"dir" usage:"where downloads and renditions are written"`
+	MinFreeMB int    `json:"min_free_mb" usage:"/readyz fails with less free space than this in the scratch dir"`
+}
+
+type LogConfig struct {
+	Level  string `json:"level" usage:"debug, info, warn or error"`
+	Format string `json:"format" usage:"logfmt or json"`
+}
+
+type SourceConfig struct {
+	Allow        []string `json:"allow" usage:"comma separated rules for the urls that can be converted"`
+	Deny         []string `json:"deny" usage:"comma separated rules for the urls that can't be converted"`
+	AllowPrivate bool     `json:"allow_private" usage:"allow downloads from private and loopback addresses"`
+}
+
+type BatchConfig struct {
+	Concurrency int `json:"concurrency" usage:"how many urls in a batch are converted at once"`
+	MaxSize     int `json:"max_size" usage:"the most urls a batch can have"`
+}
+
+type DownloadConfig struct {
+	Retry retryPolicy `json:"retry"`
+}
+
+type WebhookConfig struct {
+	Secret string      `json:"secret" secret:"true" usage:"callbacks are signed with it in X-Signature"`
+	Retry  retryPolicy `json:"retry"`
+}
+
+type ShutdownConfig struct {
+	GracePeriod duration `json:"grace_period" usage:"how long to wait for running conversions on SIGTERM"`
+}
+
+type IndexConfig struct {
+	Template        string   `json:"template" usage:"the html/template for the index page"`
+	Key             string   `json:"key" usage:"the key the index page is published to, for the bucket's website index document"`
+	PublishInterval duration `json:"publish_interval" usage:"how often to publish the index page, or 0 for never"`
+	PublishEvery    int      `json:"publish_every" usage:"publish the index page after this many uploads, or 0 for never"`
+}
+
+// GIFConfig is for the optional gif rendition, which is made smaller than the
+// original by capping its width and frame rate and giving it one palette.
+type GIFConfig struct {
+	Enabled  bool `json:"enabled" usage:"make a palette-optimized gif rendition too"`
+	MaxWidth int  `json:"max_width" usage:"the widest the gif rendition can be"`
+	FPS      int  `json:"fps" usage:"the highest frame rate the gif rendition can have"`
+}
+
+// ObjectHeaders are the headers objects are uploaded with. They can be set
+// for every rendition, and overridden for each one.
+type ObjectHeaders struct {
+	CacheControl string `json:"cache_control" usage:"the Cache-Control header"`
+	ACL          string `json:"acl" usage:"the canned ACL, like public-read"`
+	StorageClass string `json:"storage_class" usage:"the storage class, like STANDARD_IA"`
+}
+
+type S3Config struct {
+	BucketName         string `json:"bucket_name" usage:"the bucket to upload to"`
+	BucketHost         string `json:"bucket_host" usage:"the url the bucket is served from"`
+	KeyTemplate        string `json:"key_template" usage:"the key each rendition is uploaded to"`
+	Endpoint           string `json:"endpoint" usage:"the host of an S3-compatible service"`
+	Region             string `json:"region" usage:"the AWS region the bucket is in"`
+	Scheme             string `json:"scheme" usage:"http or https"`
+	PathStyle          bool   `json:"path_style" usage:"put the bucket in the path instead of the host"`
+	Credentials        string `json:"credentials" usage:"env, instance or file"`
+	CredentialsFile    string `json:"credentials_file" usage:"the AWS credentials file, when credentials is file"`
+	CredentialsProfile string `json:"credentials_profile" usage:"the profile in the credentials file"`
+	Verify             bool   `json:"verify" usage:"check each object after uploading it"`
+	TombstonePrefix    string `json:"tombstone_prefix" usage:"where markers for deleted gifs are kept in the bucket"`
+	RecordPrefix       string `json:"record_prefix" usage:"where the record of each conversion is kept in the bucket"`
+
+	ObjectHeaders
+	Video  ObjectHeaders `json:"video"`
+	Poster ObjectHeaders `json:"poster"`
+	GIF    ObjectHeaders `json:"gif"`
+
+	PutRetry retryPolicy `json:"put_retry"`
+
+	Archive ArchiveConfig `json:"archive"`
+}
+
+// ArchiveConfig is where the original gifs are kept, when they are, so they
+// can be converted again after the origin has gone away.
+type ArchiveConfig struct {
+	Enabled     bool   `json:"enabled" usage:"store the original gif along with the renditions"`
+	BucketName  string `json:"bucket_name" usage:"the bucket to store originals in, instead of s3.bucket_name"`
+	BucketHost  string `json:"bucket_host" usage:"the url that bucket is served from"`
+	KeyTemplate string `json:"key_template" usage:"the key each original is stored under"`
+
+	ObjectHeaders
+}
+
+type AWSConfig struct {
+	AccessKeyID     string `json:"access_key_id" usage:"used when s3 credentials is env"`
+	SecretAccessKey string `json:"secret_access_key" secret:"true" usage:"used when s3 credentials is env"`
+	SecurityToken   string `json:"security_token" secret:"true" usage:"used when s3 credentials is env"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Port:                 "9090",
+		MetadataPath:         "metadata.json",
+		MetadataSyncInterval: duration(5 * time.Minute),
+		MaxConcurrentJobs:    4,
+		FFmpegPath:           "vendor/ffmpeg-2.7-64bit-static/ffmpeg",
+		ConvertPath:          "convert",
+		Scratch: ScratchConfig{
+			Dir:       filepath.Join(os.TempDir(), "ancientcitadelgifs"),
+			MinFreeMB: 512,
+		},
+		Log:   LogConfig{Level: "info", Format: "logfmt"},
+		Batch: BatchConfig{Concurrency: 4, MaxSize: 500},
+		Download: DownloadConfig{Retry: retryPolicy{
+			Name:         "download",
+			Attempts:     4,
+			InitialDelay: duration(500 * time.Millisecond),
+			MaxDelay:     duration(10 * time.Second),
+			Multiplier:   2,
+			Jitter:       0.5,
+		}},
+		Webhook: WebhookConfig{Retry: retryPolicy{
+			Name:         "webhook",
+			Attempts:     8,
+			InitialDelay: duration(time.Second),
+			MaxDelay:     duration(5 * time.Minute),
+			Multiplier:   2,
+			Jitter:       0.5,
+			StopOnDrain:  true,
+		}},
+		Shutdown: ShutdownConfig{
+			// Heroku sends SIGKILL 30 seconds after SIGTERM, so leave a few
+			// seconds to clean up after the grace period runs out.
+			GracePeriod: duration(25 * time.Second),
+		},
+		Index: IndexConfig{
+			Template:        "s3-index-document.html",
+			Key:             "index.html",
+			PublishInterval: duration(time.Hour),
+		},
+		GIF: GIFConfig{
+			MaxWidth: 480,
+			FPS:      15,
+		},
+		S3: S3Config{
+			KeyTemplate:        "{hash}.{ext}",
+			Scheme:             "https",
+			Credentials:        "env",
+			CredentialsProfile: "default",
+			TombstonePrefix:    ".tombstones/",
+			RecordPrefix:       ".conversions/",
+			ObjectHeaders:      ObjectHeaders{CacheControl: "public, max-age=31536000, immutable"},
+			PutRetry: retryPolicy{
+				Name:         "s3put",
+				Attempts:     3,
+				InitialDelay: duration(time.Second),
+				MaxDelay:     duration(30 * time.Second),
+				Multiplier:   2,
+				Jitter:       0.5,
+			},
+			Archive: ArchiveConfig{KeyTemplate: "originals/{hash}.{ext}"},
+		},
+	}
+}
+
+var config = defaultConfig()
+
+// duration is a time.Duration written like "25s" in the config file.
+type duration time.Duration
+
+func (d duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.New(fmt.Sprintf("%s is not a duration like \"25s\"", b))
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+var durationType = reflect.TypeOf(duration(0))
+
+// configField is one setting, found by walking the Config struct.
+type configField struct {
+	path   string
+	value  reflect.Value
+	usage  string
+	secret bool
+}
+
+func (f configField) env() string {
+	return strings.ToUpper(strings.Replace(f.path, ".", "_", -1))
+}
+
+func (f configField) flag() string {
+	return strings.Replace(strings.Replace(f.path, ".", "-", -1), "_", "-", -1)
+}
+
+func (f configField) String() string {
+	switch v := f.value.Interface().(type) {
+	case []string:
+		return strings.Join(v, ",")
+	}
+	return fmt.Sprint(f.value.Interface())
+}
+
+func (f configField) set(s string) error {
+	if f.value.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		f.value.SetInt(int64(d))
+		return nil
+	}
+	switch f.value.Kind() {
+	case reflect.String:
+		f.value.SetString(s)
+	case reflect.Int:
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			return errors.New(fmt.Sprintf("%q is not an integer", s))
+		}
+		f.value.SetInt(int64(i))
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return errors.New(fmt.Sprintf("%q is not a number", s))
+		}
+		f.value.SetFloat(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return errors.New(fmt.Sprintf("%q is not true or false", s))
+		}
+		f.value.SetBool(b)
+	case reflect.Slice:
+		var list []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		f.value.Set(reflect.ValueOf(list))
+	}
+	return nil
+}
+
+// configFields lists every setting in v, which must be a struct. Nested
+// structs add their json name to the path, and embedded ones don't.
+func configFields(v reflect.Value, prefix string) []configField {
+	var fields []configField
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		name := strings.Split(sf.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		path := prefix
+		if name != "" && prefix != "" {
+			path = prefix + "." + name
+		} else if name != "" {
+			path = name
+		}
+		if sf.Type.Kind() == reflect.Struct {
+			fields = append(fields, configFields(v.Field(i), path)...)
+			continue
+		}
+		fields = append(fields, configField{
+			path:   path,
+			value:  v.Field(i),
+			usage:  sf.Tag.Get("usage"),
+			secret: sf.Tag.Get("secret") == "true",
+		})
+	}
+	return fields
+}
+
+func (c *Config) fields() []configField {
+	return configFields(reflect.ValueOf(c).Elem(), "")
+}
+
+// flagSetting records a flag so it can be applied after the config file and
+// the environment.
+type flagSetting struct {
+	field  *configField
+	values map[string]string
+}
+
+func (f *flagSetting) String() string {
+	if f.field == nil || f.field.secret {
+		return ""
+	}
+	return f.field.String()
+}
+
+func (f *flagSetting) Set(s string) error {
+	f.values[f.field.flag()] = s
+	return nil
+}
+
+func (f *flagSetting) IsBoolFlag() bool {
+	return f.field != nil && f.field.value.Kind() == reflect.Bool
+}
+
+// loadConfig starts with the defaults, then applies the config file given
+// by -config or CONFIG_PATH, then the environment and then the rest of the
+// flags in args. Any flags of the command's own must already be defined on
+// flags. The config still needs validating.
+func loadConfig(flags *flag.FlagSet, args []string) (*Config, error) {
+	c := defaultConfig()
+	fields := c.fields()
+
+	configPath := flags.String("config", os.Getenv("CONFIG_PATH"), "a JSON config file")
+	flagValues := map[string]string{}
+	for i := range fields {
+		flags.Var(&flagSetting{field: &fields[i], values: flagValues}, fields[i].flag(), fields[i].usage)
+	}
+	flags.Parse(args)
+
+	if *configPath != "" {
+		if err := c.readFile(*configPath); err != nil {
+			return nil, err
+		}
+	}
+
+	var problems configError
+	for _, f := range fields {
+		if v := os.Getenv(f.env()); v != "" {
+			if err := f.set(v); err != nil {
+				problems = append(problems, fmt.Sprintf("%v: %v", f.env(), err))
+			}
+		}
+	}
+	for _, f := range fields {
+		if v, ok := flagValues[f.flag()]; ok {
+			if err := f.set(v); err != nil {
+				problems = append(problems, fmt.Sprintf("-%v: %v", f.flag(), err))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return nil, problems
+	}
+	return c, nil
+}
+
+// readFile applies the settings in a JSON config file, which can leave out
+// any it doesn't want to change. Settings it doesn't know are an error, so
+// typos don't go unnoticed.
+func (c *Config) readFile(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var raw map[string]interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return errors.New(fmt.Sprintf("%v: %v", path, err))
+	}
+
+	known := map[string]bool{}
+	for _, f := range c.fields() {
+		parts := strings.Split(f.path, ".")
+		for i := range parts {
+			known[strings.Join(parts[:i+1], ".")] = true
+		}
+	}
+	var problems configError
+	var check func(prefix string, m map[string]interface{})
+	check = func(prefix string, m map[string]interface{}) {
+		for k, v := range m {
+			p := k
+			if prefix != "" {
+				p = prefix + "." + k
+			}
+			if !known[p] {
+				problems = append(problems, fmt.Sprintf("%v: unknown setting %q", path, p))
+				continue
+			}
+			if nested, ok := v.(map[string]interface{}); ok {
+				check(p, nested)
+			}
+		}
+	}
+	check("", raw)
+	if len(problems) > 0 {
+		return problems
+	}
+
+	if err := json.Unmarshal(b, c); err != nil {
+		return errors.New(fmt.Sprintf("%v: %v", path, err))
+	}
+	return nil
+}
+
+// configError lists everything wrong with a config, one problem per line.
+type configError []string
+
+func (e configError) Error() string {
+	return "invalid config:\n  " + strings.Join(e, "\n  ")
+}
+
+// validate checks every setting, and the S3 ones when needS3 is set, and
+// reports all the problems it finds at once.
+func (c *Config) validate(needS3 bool) error {
+	var problems configError
+	problem := func(path string, format string, args ...interface{}) {
+		env := configField{path: path}.env()
+		problems = append(problems, fmt.Sprintf("%v (%v) %v", path, env, fmt.Sprintf(format, args...)))
+	}
+	positive := func(path string, i int) {
+		if i < 1 {
+			problem(path, "must be at least 1, got %d", i)
+		}
+	}
+	required := func(path string, s string) {
+		if s == "" {
+			problem(path, "is required")
+		}
+	}
+
+	if port, err := strconv.Atoi(c.Port); err != nil || port < 1 || port > 65535 {
+		problem("port", "must be a port number, got %q", c.Port)
+	}
+	required("metadata_path", c.MetadataPath)
+	positive("max_concurrent_jobs", c.MaxConcurrentJobs)
+	executable := func(path string, name string) {
+		required(path, name)
+		if name == "" {
+			return
+		}
+		if _, err := exec.LookPath(name); err != nil {
+			problem(path, "can't be run: %v", err)
+		}
+	}
+	executable("ffmpeg_path", c.FFmpegPath)
+	executable("convert_path", c.ConvertPath)
+	required("scratch.dir", c.Scratch.Dir)
+	if c.Scratch.Dir != "" {
+		dir, err := filepath.Abs(c.Scratch.Dir)
+		wd, wdErr := os.Getwd()
+		if err == nil && wdErr == nil && dir == wd {
+			problem("scratch.dir", "can't be the working directory, use a directory of its own")
+		}
+	}
+	if c.Scratch.MinFreeMB < 0 {
+		problem("scratch.min_free_mb", "can't be negative, got %d", c.Scratch.MinFreeMB)
+	}
+
+	if _, err := parseLogLevel(c.Log.Level); err != nil {
+		problem("log.level", "%v", err)
+	}
+	if c.Log.Format != "logfmt" && c.Log.Format != "json" {
+		problem("log.format", "must be logfmt or json, got %q", c.Log.Format)
+	}
+
+	if _, err := parseSourceRules(c.Source.Allow); err != nil {
+		problem("source.allow", "%v", err)
+	}
+	if _, err := parseSourceRules(c.Source.Deny); err != nil {
+		problem("source.deny", "%v", err)
+	}
+
+	positive("batch.concurrency", c.Batch.Concurrency)
+	positive("batch.max_size", c.Batch.MaxSize)
+
+	checkRetry := func(path string, p retryPolicy) {
+		positive(path+".attempts", p.Attempts)
+		if p.InitialDelay < 0 {
+			problem(path+".initial_delay", "can't be negative, got %v", p.InitialDelay)
+		}
+		if p.MaxDelay < p.InitialDelay {
+			problem(path+".max_delay", "can't be less than initial_delay, got %v", p.MaxDelay)
+		}
+		if p.Multiplier < 1 {
+			problem(path+".multiplier", "must be at least 1, got %v", p.Multiplier)
+		}
+		if p.Jitter < 0 || p.Jitter > 1 {
+			problem(path+".jitter", "must be between 0 and 1, got %v", p.Jitter)
+		}
+	}
+	checkRetry("download.retry", c.Download.Retry)
+	checkRetry("webhook.retry", c.Webhook.Retry)
+	checkRetry("s3.put_retry", c.S3.PutRetry)
+
+	if c.GIF.Enabled {
+		positive("gif.max_width", c.GIF.MaxWidth)
+		positive("gif.fps", c.GIF.FPS)
+	}
+
+	required("index.template", c.Index.Template)
+	required("index.key", c.Index.Key)
+	if c.Index.PublishInterval < 0 {
+		problem("index.publish_interval", "can't be negative, got %v", c.Index.PublishInterval)
+	}
+	if c.Index.PublishEvery < 0 {
+		problem("index.publish_every", "can't be negative, got %d", c.Index.PublishEvery)
+	}
+
+	if c.Shutdown.GracePeriod < 0 {
+		problem("shutdown.grace_period", "can't be negative, got %v", c.Shutdown.GracePeriod)
+	}
+
+	if needS3 {
+		c.validateS3(problem)
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// sigV2Regions are the AWS regions that still accept requests signed with
+// Signature Version 2, which is all s3gof3r signs with. Every region opened
+// since 2014 only takes version 4.
+var sigV2Regions = map[string]bool{
+	"us-east-1":      true,
+	"us-west-1":      true,
+	"us-west-2":      true,
+	"eu-west-1":      true,
+	"ap-northeast-1": true,
+	"ap-southeast-1": true,
+	"ap-southeast-2": true,
+	"sa-east-1":      true,
+}
+
+func (c *Config) validateS3(problem func(path string, format string, args ...interface{})) {
+	required := func(path string, s string) {
+		if s == "" {
+			problem(path, "is required")
+		}
+	}
+	required("s3.bucket_name", c.S3.BucketName)
+	required("s3.bucket_host", c.S3.BucketHost)
+	required("s3.tombstone_prefix", c.S3.TombstonePrefix)
+	required("s3.record_prefix", c.S3.RecordPrefix)
+	if c.S3.RecordPrefix != "" && (strings.HasPrefix(c.S3.RecordPrefix, c.S3.TombstonePrefix) || strings.HasPrefix(c.S3.TombstonePrefix, c.S3.RecordPrefix)) {
+		problem("s3.record_prefix", "can't overlap s3.tombstone_prefix")
+	}
+	allRenditions := append(baseRenditions[:len(baseRenditions):len(baseRenditions)], optimizedGIFRendition)
+	if err := checkKeyTemplate(c.S3.KeyTemplate, allRenditions); err != nil {
+		problem("s3.key_template", "%v", err)
+	}
+	if c.S3.Archive.Enabled {
+		if err := checkKeyTemplate(c.S3.Archive.KeyTemplate, []rendition{originalRendition}); err != nil {
+			problem("s3.archive.key_template", "%v", err)
+		}
+		if c.S3.Archive.BucketName != "" && c.S3.Archive.BucketHost == "" {
+			problem("s3.archive.bucket_host", "is required when s3.archive.bucket_name is set")
+		}
+		// The gif rendition and the original both end in .gif, so they'd
+		// overwrite each other with the same key in the same bucket.
+		hash := strings.Repeat("0", 32)
+		sameBucket := c.S3.Archive.BucketName == "" || c.S3.Archive.BucketName == c.S3.BucketName
+		for _, r := range allRenditions {
+			if sameBucket && fillKeyTemplate(c.S3.Archive.KeyTemplate, hash, originalRendition) == fillKeyTemplate(c.S3.KeyTemplate, hash, r) {
+				problem("s3.archive.key_template", "gives originals the same keys as the %v rendition", r.Extension)
+			}
+		}
+	}
+	if c.S3.Endpoint == "" && c.S3.Region != "" && !sigV2Regions[c.S3.Region] {
+		problem("s3.region", "%q only accepts Signature Version 4, and requests to S3 are signed with version 2", c.S3.Region)
+	}
+	if c.S3.Scheme != "http" && c.S3.Scheme != "https" {
+		problem("s3.scheme", "must be http or https, got %q", c.S3.Scheme)
+	}
+	switch c.S3.Credentials {
+	case "env":
+		if c.AWS.AccessKeyID == "" || c.AWS.SecretAccessKey == "" {
+			problem("s3.credentials", "is env, so aws.access_key_id (AWS_ACCESS_KEY_ID) and aws.secret_access_key (AWS_SECRET_ACCESS_KEY) are required")
+		}
+	case "instance":
+	case "file":
+		if _, err := fileKeys(c.S3.CredentialsFile, c.S3.CredentialsProfile); err != nil {
+			problem("s3.credentials_file", "%v", err)
+		}
+	default:
+		problem("s3.credentials", "must be env, instance or file, got %q", c.S3.Credentials)
+	}
+}
+
+// useConfig makes c the config, and sets up everything that's worked out
+// from it.
+func useConfig(c *Config) {
+	config = c
+	minLogLevel, _ = parseLogLevel(c.Log.Level)
+	logJSON = c.Log.Format == "json"
+	sourceAllowRules, _ = parseSourceRules(c.Source.Allow)
+	sourceDenyRules, _ = parseSourceRules(c.Source.Deny)
+	jobSlots = make(chan struct{}, c.MaxConcurrentJobs)
+	renditions = baseRenditions
+	if c.GIF.Enabled {
+		renditions = append(baseRenditions[:len(baseRenditions):len(baseRenditions)], optimizedGIFRendition)
+	}
+}
+
+// logFields lists every setting for logging, with secrets redacted.
+func (c *Config) logFields() []interface{} {
+	var fields []interface{}
+	for _, f := range c.fields() {
+		v := f.String()
+		if f.secret && v != "" {
+			v = "[redacted]"
+		}
+		fields = append(fields, f.path, v)
+	}
+	return fields
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfigFile writes body to a config file in a new directory, and
+// returns its path and a function that removes it.
+func writeConfigFile(t *testing.T, body string) (string, func()) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(path, []byte(body), 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+// setenv sets the environment variables in env, and returns a function that
+// unsets them again.
+func setenv(env map[string]string) func() {
+	for k, v := range env {
+		os.Setenv(k, v)
+	}
+	return func() {
+		for k := range env {
+			os.Unsetenv(k)
+		}
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path, remove := writeConfigFile(t, `{
+		"port": "1000",
+		"max_concurrent_jobs": 2,
+		"s3": {"bucket_name": "from-file", "bucket_host": "https://file.example.com", "video": {"cache_control": "no-cache"}},
+		"shutdown": {"grace_period": "10s"}
+	}`)
+	defer remove()
+	defer setenv(map[string]string{
+		"PORT":                  "2000",
+		"S3_BUCKET_HOST":        "https://env.example.com",
+		"SOURCE_ALLOW":          "giphy.com, *.imgur.com,",
+		"SHUTDOWN_GRACE_PERIOD": "15s",
+	})()
+
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	c, err := loadConfig(flags, []string{"-config", path, "-port", "3000", "-gif-enabled"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		setting string
+		got     interface{}
+		want    interface{}
+	}{
+		{"port, from the flag", c.Port, "3000"},
+		{"s3.bucket_host, from the environment", c.S3.BucketHost, "https://env.example.com"},
+		{"s3.bucket_name, from the file", c.S3.BucketName, "from-file"},
+		{"max_concurrent_jobs, from the file", c.MaxConcurrentJobs, 2},
+		{"s3.video.cache_control, from the file", c.S3.Video.CacheControl, "no-cache"},
+		{"s3.cache_control, the default", c.S3.CacheControl, "public, max-age=31536000, immutable"},
+		{"shutdown.grace_period, from the environment", c.Shutdown.GracePeriod, duration(15 * time.Second)},
+		{"source.allow, from the environment", c.Source.Allow, []string{"giphy.com", "*.imgur.com"}},
+		{"gif.enabled, from the flag", c.GIF.Enabled, true},
+		{"gif.max_width, the default", c.GIF.MaxWidth, 480},
+	}
+	for _, test := range tests {
+		if !reflect.DeepEqual(test.got, test.want) {
+			t.Errorf("%v = %#v, want %#v", test.setting, test.got, test.want)
+		}
+	}
+}
+
+func TestLoadConfigInvalidValues(t *testing.T) {
+	defer setenv(map[string]string{
+		"MAX_CONCURRENT_JOBS":   "lots",
+		"SHUTDOWN_GRACE_PERIOD": "a while",
+	})()
+
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	_, err := loadConfig(flags, []string{"-gif-fps=fast"})
+	if err == nil {
+		t.Fatal("loadConfig() = nil, want an error")
+	}
+	for _, want := range []string{"MAX_CONCURRENT_JOBS", "SHUTDOWN_GRACE_PERIOD", "-gif-fps"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("loadConfig() = %q, want it to mention %v", err, want)
+		}
+	}
+}
+
+func TestReadFileUnknownSettings(t *testing.T) {
+	path, remove := writeConfigFile(t, `{
+		"port": "1000",
+		"s3": {"bucket_nmae": "typo", "video": {"cache_contrl": "typo"}},
+		"colour": "blue"
+	}`)
+	defer remove()
+
+	c := defaultConfig()
+	err := c.readFile(path)
+	if err == nil {
+		t.Fatal("readFile() = nil, want an error")
+	}
+	for _, want := range []string{`"s3.bucket_nmae"`, `"s3.video.cache_contrl"`, `"colour"`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("readFile() = %q, want it to mention %v", err, want)
+		}
+	}
+	if c.Port != "9090" {
+		t.Errorf("port = %q, a file with unknown settings shouldn't be applied", c.Port)
+	}
+}
+
+func TestReadFileErrors(t *testing.T) {
+	for _, body := range []string{
+		`{"port": `,
+		`{"max_concurrent_jobs": "four"}`,
+		`{"shutdown": {"grace_period": "soon"}}`,
+	} {
+		path, remove := writeConfigFile(t, body)
+		if err := defaultConfig().readFile(path); err == nil {
+			t.Errorf("readFile() of %v = nil, want an error", body)
+		}
+		remove()
+	}
+	if err := defaultConfig().readFile("/does/not/exist.json"); err == nil {
+		t.Error("readFile() of a missing file = nil, want an error")
+	}
+}
+
+func validTestConfig() *Config {
+	c := defaultConfig()
+	c.S3.BucketName = "gifs"
+	c.S3.BucketHost = "https://gifs.example.com"
+	c.AWS.AccessKeyID = "key"
+	c.AWS.SecretAccessKey = "secret"
+	// The test binary stands in for ffmpeg and convert, which needn't be
+	// installed to run the tests.
+	c.FFmpegPath = os.Args[0]
+	c.ConvertPath = os.Args[0]
+	return c
+}
+
+func TestValidate(t *testing.T) {
+	if err := validTestConfig().validate(true); err != nil {
+		t.Errorf("validate() = %v, want nil", err)
+	}
+	if err := validTestConfig().validate(false); err != nil {
+		t.Errorf("validate() without S3 = %v, want nil", err)
+	}
+}
+
+func TestValidateProblems(t *testing.T) {
+	tests := []struct {
+		change func(*Config)
+		needS3 bool
+		want   string
+	}{
+		{func(c *Config) { c.Port = "http" }, false, "port (PORT)"},
+		{func(c *Config) { c.Port = "70000" }, false, "port (PORT)"},
+		{func(c *Config) { c.MaxConcurrentJobs = 0 }, false, "max_concurrent_jobs (MAX_CONCURRENT_JOBS)"},
+		{func(c *Config) { c.FFmpegPath = "vendor/no-such-ffmpeg/ffmpeg" }, false, "ffmpeg_path (FFMPEG_PATH)"},
+		{func(c *Config) { c.ConvertPath = "no-such-convert" }, false, "convert_path (CONVERT_PATH)"},
+		{func(c *Config) { c.ConvertPath = "" }, false, "convert_path (CONVERT_PATH) is required"},
+		{func(c *Config) { c.Scratch.Dir = "." }, false, "scratch.dir (SCRATCH_DIR)"},
+		{func(c *Config) { c.Log.Format = "xml" }, false, "log.format (LOG_FORMAT)"},
+		{func(c *Config) { c.Source.Allow = []string{"ftp://giphy.com"} }, false, "source.allow (SOURCE_ALLOW)"},
+		{func(c *Config) { c.Webhook.Retry.Jitter = 2 }, false, "webhook.retry.jitter (WEBHOOK_RETRY_JITTER)"},
+		{func(c *Config) { c.GIF.Enabled, c.GIF.FPS = true, 0 }, false, "gif.fps (GIF_FPS)"},
+		{func(c *Config) { c.S3.BucketName = "" }, true, "s3.bucket_name (S3_BUCKET_NAME)"},
+		{func(c *Config) { c.S3.KeyTemplate = "{hash}" }, true, "s3.key_template (S3_KEY_TEMPLATE)"},
+		{func(c *Config) { c.S3.RecordPrefix = c.S3.TombstonePrefix }, true, "s3.record_prefix (S3_RECORD_PREFIX)"},
+		{func(c *Config) { c.S3.Region = "eu-central-1" }, true, "s3.region (S3_REGION)"},
+		{func(c *Config) { c.AWS.SecretAccessKey = "" }, true, "s3.credentials (S3_CREDENTIALS)"},
+		{func(c *Config) { c.S3.Archive.Enabled, c.S3.Archive.KeyTemplate = true, "{hash}.{ext}" }, true, "s3.archive.key_template (S3_ARCHIVE_KEY_TEMPLATE)"},
+	}
+	for _, test := range tests {
+		c := validTestConfig()
+		test.change(c)
+		err := c.validate(test.needS3)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("validate() = %v, want a problem with %v", err, test.want)
+		}
+	}
+
+	c := validTestConfig()
+	c.S3.BucketName = ""
+	if err := c.validate(false); err != nil {
+		t.Errorf("validate() without S3 = %v, want the S3 settings left alone", err)
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	c := validTestConfig()
+	c.Port = ""
+	c.Batch.MaxSize = 0
+	c.S3.BucketHost = ""
+	err := c.validate(true)
+	if err == nil {
+		t.Fatal("validate() = nil, want an error")
+	}
+	if problems, ok := err.(configError); !ok || len(problems) != 3 {
+		t.Errorf("validate() = %q, want 3 problems", err)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// convertCommand runs a url or a local gif through the same pipeline as
+// /upload, without the server. The renditions are written to -output, and
+// only uploaded with -upload. The UploadResult is printed on stdout, so the
+// logs go to stderr.
+func convertCommand(args []string) error {
+	flags := flag.NewFlagSet("convert", flag.ExitOnError)
+	outputDir := flags.String("output", ".", "the directory to write the renditions to")
+	upload := flags.Bool("upload", false, "upload the renditions and record them in the metadata store")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %v convert [flags] <url or path>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	c, err := loadConfig(flags, args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if err := c.validate(*upload); err != nil {
+		return err
+	}
+	useConfig(c)
+	logOutput = os.Stderr
+
+	if err := os.MkdirAll(config.Scratch.Dir, 0755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(*outputDir, 0755); err != nil {
+		return err
+	}
+	if *upload {
+		store, err = openSharedStore()
+		if err != nil {
+			return err
+		}
+	}
+
+	gifURL, err := sourceURL(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	result, err := runConversion(rootLogger, gifURL, nil, conversionOptions{
+		OutputDir:  *outputDir,
+		SkipUpload: !*upload,
+	})
+	if err != nil {
+		return err
+	}
+
+	js, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", js)
+	return nil
+}
+
+// sourceURL returns arg if it's an http or https url. Anything else is taken
+// to be a local gif, and given a file:// url after being staged with
+// stageLocalFile.
+func sourceURL(arg string) (string, error) {
+	if u, err := url.Parse(arg); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		return arg, nil
+	}
+
+	path, err := filepath.Abs(arg)
+	if err != nil {
+		return "", err
+	}
+	gifURL := (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+	return gifURL, stageLocalFile(gifURL)
+}
+
+// stageLocalFile copies the gif at a file:// url to where downloadFile would
+// have put it, since downloadFile only fetches over http. The server never
+// does this, so only the commands can convert local files.
+func stageLocalFile(gifURL string) error {
+	u, err := url.Parse(gifURL)
+	if err != nil {
+		return err
+	}
+	path := filepath.FromSlash(u.Path)
+	if fi, err := os.Stat(path); err != nil {
+		return err
+	} else if fi.IsDir() {
+		return errors.New(fmt.Sprintf("%v is a directory", path))
+	}
+	return copyFile(path, outputPath(gifURL, "gif"))
+}
+
+func copyFile(from string, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(to)
+		return err
+	}
+	return out.Close()
+}
+
+// moveFile renames from to to, copying it instead when they're on different
+// filesystems.
+func moveFile(from string, to string) error {
+	if err := os.Rename(from, to); err == nil {
+		return nil
+	}
+	if err := copyFile(from, to); err != nil {
+		return err
+	}
+	return os.Remove(from)
+}
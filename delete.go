@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var hashPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+type DeleteResult struct {
+	Hash        string   `json:"hash"`
+	DeletedKeys []string `json:"deleted"`
+}
+
+func deleteHandler(w http.ResponseWriter, r *http.Request) {
+	log := requestLogger(r)
+	w.Header().Set("Content-Type", "application/json")
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	hash := mux.Vars(r)["hash"]
+	sourceURL := r.URL.Query().Get("u")
+	if hash == "" {
+		if sourceURL == "" {
+			serveErrorStatus(w, r, "please specify a hash or a source url to delete", http.StatusBadRequest)
+			return
+		}
+		hash = urlHash(sourceURL)
+	}
+	if !hashPattern.MatchString(hash) {
+		serveErrorStatus(w, r, fmt.Sprintf("%q is not a valid hash", hash), http.StatusBadRequest)
+		return
+	}
+	// Wait for any conversion of it to finish, and stop another starting
+	// until it's been tombstoned.
+	lockHash(hash)
+	defer unlockHash(hash)
+
+	keys := map[string]bool{}
+	for _, rendition := range renditions {
+		keys[objectKey(hash, rendition)] = true
+	}
+	var original *archivedOriginal
+	if c, ok := store.conversion(hash); ok {
+		for _, key := range c.Keys {
+			keys[key] = true
+		}
+		if sourceURL == "" {
+			sourceURL = c.SourceURL
+		}
+		original = c.Original
+	}
+
+	result := DeleteResult{Hash: hash}
+	for key := range keys {
+		result.DeletedKeys = append(result.DeletedKeys, key)
+	}
+	sort.Strings(result.DeletedKeys)
+	for _, key := range result.DeletedKeys {
+		log.info("deleting", "hash", hash, "key", key)
+		err := deleteFromS3(key)
+		if err != nil {
+			serveError(w, r, err.Error())
+			return
+		}
+	}
+
+	if original != nil {
+		log.info("deleting original", "hash", hash, "bucket", original.Bucket, "key", original.Key)
+		if err := deleteFromBucket(original.Bucket, original.Key); err != nil {
+			serveError(w, r, err.Error())
+			return
+		}
+		result.DeletedKeys = append(result.DeletedKeys, original.Key)
+	}
+
+	paths := []string{scratchPath(hash, "gif")}
+	for _, rendition := range renditions {
+		paths = append(paths, renditionPath(hash, rendition))
+	}
+	for _, path := range paths {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			serveError(w, r, err.Error())
+			return
+		}
+	}
+
+	t := tombstone{
+		Hash:      hash,
+		SourceURL: sourceURL,
+		Reason:    r.URL.Query().Get("reason"),
+		DeletedAt: time.Now().UTC(),
+	}
+	if err := putTombstone(log, t); err != nil {
+		serveError(w, r, err.Error())
+		return
+	}
+	log.info("deleting record", "hash", hash, "key", recordKey(hash))
+	if err := deleteFromS3(recordKey(hash)); err != nil {
+		serveError(w, r, err.Error())
+		return
+	}
+	if err := store.bury(t); err != nil {
+		serveError(w, r, err.Error())
+		return
+	}
+
+	js, err := json.Marshal(result)
+	if err != nil {
+		serveError(w, r, err.Error())
+		return
+	}
+	w.Write(js)
+}
+
+// tombstoneKey is where the marker for a deleted hash is kept in the bucket.
+// Every server checks for it before converting, so a hash deleted through
+// one stays deleted on all of them.
+func tombstoneKey(hash string) string {
+	return config.S3.TombstonePrefix + hash
+}
+
+func putTombstone(log *logger, t tombstone) error {
+	body, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("x-amz-acl", "private")
+	return putBytesToS3(log, body, tombstoneKey(t.Hash), header)
+}
+
+// findTombstone looks for a tombstone for hash in the metadata store, and
+// then in the bucket, in case it was deleted by another server. Ones found
+// in the bucket are recorded in the store, so they're only fetched once.
+func findTombstone(hash string) (tombstone, bool, error) {
+	if t, ok := store.tombstone(hash); ok {
+		return t, true, nil
+	}
+	b, ok, err := getObject(tombstoneKey(hash))
+	if err != nil || !ok {
+		return tombstone{}, false, err
+	}
+
+	t := tombstone{Hash: hash}
+	json.Unmarshal(b, &t)
+	t.Hash = hash
+	if err := store.bury(t); err != nil {
+		return tombstone{}, false, err
+	}
+	return t, true, nil
+}
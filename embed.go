@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AndrewVos/ancientcitadelgifs/signature"
+	"github.com/gorilla/mux"
+)
+
+var embedTemplate = template.Must(template.New("embed").Parse(`<!DOCTYPE html>
+<html lang="en">
+  <head>
+    <meta charset="utf-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <style>
+      html, body { margin: 0; padding: 0; background: transparent; }
+      video { display: block; width: 100%; max-width: {{.Result.Width}}px; height: auto; }
+    </style>
+  </head>
+  <body>
+    <video autoplay loop muted playsinline width="{{.Result.Width}}" height="{{.Result.Height}}" poster="{{.Result.PNGURL}}">
+      <source src="{{.Result.WEBMURL}}" type="video/webm">
+      <source src="{{.Result.MP4URL}}" type="video/mp4">
+    </video>
+  </body>
+</html>
+`))
+
+var embedIframeTemplate = template.Must(template.New("iframe").Parse(
+	`<iframe src="{{.Src}}" width="{{.Width}}" height="{{.Height}}" frameborder="0" scrolling="no" allowfullscreen></iframe>`))
+
+type OEmbed struct {
+	Type            string `json:"type"`
+	Version         string `json:"version"`
+	ProviderName    string `json:"provider_name"`
+	Width           int    `json:"width"`
+	Height          int    `json:"height"`
+	HTML            string `json:"html"`
+	ThumbnailURL    string `json:"thumbnail_url"`
+	ThumbnailWidth  int    `json:"thumbnail_width"`
+	ThumbnailHeight int    `json:"thumbnail_height"`
+}
+
+var hashPath = regexp.MustCompile(`^/(?:embed/)?([0-9a-f]{32})(?:\.[a-z0-9]+)?$`)
+
+// embedHash works out which conversion rawurl is about. It can be an embed
+// page, an asset on this service, or the url of the original gif.
+func embedHash(rawurl string) string {
+	if u, err := url.Parse(rawurl); err == nil {
+		if m := hashPath.FindStringSubmatch(u.Path); m != nil {
+			if _, ok, _ := findConversion(m[1]); ok {
+				return m[1]
+			}
+		}
+	}
+	return urlHash(rawurl)
+}
+
+// embeddedConversion returns the conversion for hash, serving a 404, or a
+// 410 if it was deleted, when there isn't one. Conversions other servers
+// made are looked up in the bucket.
+func embeddedConversion(w http.ResponseWriter, r *http.Request, hash string) (conversion, bool) {
+	c, ok, err := findConversion(hash)
+	if err != nil {
+		serveError(w, r, err.Error())
+		return conversion{}, false
+	}
+	if ok {
+		return c, true
+	}
+	t, removed, err := findTombstone(hash)
+	switch {
+	case err != nil:
+		serveError(w, r, err.Error())
+	case removed:
+		err := removedError{t.SourceURL}
+		serveErrorStatus(w, r, err.Error(), errorStatus(err))
+	default:
+		serveErrorStatus(w, r, "no gif has been converted from that url", http.StatusNotFound)
+	}
+	return conversion{}, false
+}
+
+func embedHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireSignature(w, r) {
+		return
+	}
+	c, ok := embeddedConversion(w, r, mux.Vars(r)["hash"])
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := embedTemplate.Execute(w, c); err != nil {
+		requestLogger(r).error("rendering embed failed", "error", err)
+	}
+}
+
+// oembedHandler is an oEmbed provider for embed pages, assets and the
+// original gifs. It only speaks json. With URL_SIGNING_SECRET, the request
+// has to be signed, and the embed url it gives out is signed to expire at
+// the same time.
+func oembedHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !requireSignature(w, r) {
+		return
+	}
+	query := r.URL.Query()
+	if format := query.Get("format"); format != "" && format != "json" {
+		serveErrorStatus(w, r, fmt.Sprintf("format %q isn't supported, only json", format), http.StatusNotImplemented)
+		return
+	}
+	rawurl := query.Get("url")
+	if rawurl == "" {
+		serveErrorStatus(w, r, "please specify a url to embed", http.StatusBadRequest)
+		return
+	}
+	c, ok := embeddedConversion(w, r, embedHash(rawurl))
+	if !ok {
+		return
+	}
+
+	width, height, err := embedSize(c.Result.Width, c.Result.Height, query.Get("maxwidth"), query.Get("maxheight"))
+	if err != nil {
+		serveErrorStatus(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	src := requestBaseURL(r) + "/embed/" + c.Hash
+	if config.URLSigningSecret != "" {
+		expires, _ := strconv.ParseInt(query.Get("expires"), 10, 64)
+		src, err = signature.SignURL([]byte(config.URLSigningSecret), src, time.Unix(expires, 0))
+		if err != nil {
+			serveError(w, r, err.Error())
+			return
+		}
+	}
+	var iframe bytes.Buffer
+	err = embedIframeTemplate.Execute(&iframe, struct {
+		Src           string
+		Width, Height int
+	}{src, width, height})
+	if err != nil {
+		serveError(w, r, err.Error())
+		return
+	}
+
+	js, err := json.Marshal(OEmbed{
+		Type:            "video",
+		Version:         "1.0",
+		ProviderName:    "ancientcitadelgifs",
+		Width:           width,
+		Height:          height,
+		HTML:            iframe.String(),
+		ThumbnailURL:    c.Result.PNGURL,
+		ThumbnailWidth:  c.Result.Width,
+		ThumbnailHeight: c.Result.Height,
+	})
+	if err != nil {
+		serveError(w, r, err.Error())
+		return
+	}
+	w.Write(js)
+}
+
+// embedSize scales width and height down to fit maxwidth and maxheight,
+// when they're given, keeping the aspect ratio.
+func embedSize(width int, height int, maxwidth string, maxheight string) (int, int, error) {
+	scale := 1.0
+	for _, limit := range []struct {
+		name  string
+		value string
+		size  int
+	}{{"maxwidth", maxwidth, width}, {"maxheight", maxheight, height}} {
+		if limit.value == "" {
+			continue
+		}
+		max, err := strconv.Atoi(limit.value)
+		if err != nil || max < 1 {
+			return 0, 0, errors.New(fmt.Sprintf("invalid %v %q", limit.name, limit.value))
+		}
+		if s := float64(max) / float64(limit.size); s < scale {
+			scale = s
+		}
+	}
+	return int(float64(width) * scale), int(float64(height) * scale), nil
+}
+
+// requestBaseURL is the scheme and host the request was made to, going by
+// X-Forwarded-Proto when there's a router like Heroku's in front.
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = strings.ToLower(strings.TrimSpace(strings.Split(proto, ",")[0]))
+	}
+	return scheme + "://" + r.Host
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+)
+
+const galleryPageSize = 24
+
+var galleryTemplate = template.Must(template.New("gallery").Funcs(template.FuncMap{
+	"size": formatSize,
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+  <head>
+    <meta charset="utf-8">
+    <title>ancientcitadelgifs - {{.Total}} gifs</title>
+    <style>
+      body { font-family: sans-serif; margin: 2em; }
+      form { margin-bottom: 2em; }
+      ul { list-style: none; padding: 0; display: flex; flex-wrap: wrap; }
+      li { width: 320px; margin: 0 1em 2em 0; }
+      video { width: 320px; background: #eee; }
+      .source { word-break: break-all; font-size: small; }
+      .sizes { color: #666; font-size: small; }
+    </style>
+  </head>
+  <body>
+    <form action="/upload" method="get">
+      <input type="url" name="u" placeholder="https://example.com/some.gif" size="60" required>
+      {{if .APIKeys}}<input type="password" name="api_key" placeholder="api key" required>{{end}}
+      <button type="submit">Convert</button>
+    </form>
+    <p>{{.Total}} gifs, page {{.Page}} of {{.Pages}}</p>
+    {{if .Syncing}}<p>Still loading the gifs converted elsewhere, so some are missing.</p>{{end}}
+    <ul>
+      {{range .Conversions}}
+      <li>
+        <video autoplay loop muted playsinline poster="{{.Result.PNGURL}}">
+          <source src="{{.Result.WEBMURL}}" type="video/webm">
+          <source src="{{.Result.MP4URL}}" type="video/mp4">
+        </video>
+        <div class="source"><a href="{{.SourceURL}}">{{.SourceURL}}</a></div>
+        <div class="sizes">
+          {{.Result.Width}}&times;{{.Result.Height}},
+          original {{size (index .Result.Sizes "original")}},
+          mp4 {{size (index .Result.Sizes "mp4")}},
+          webm {{size (index .Result.Sizes "webm")}}
+          {{- with .Result.OptimizedGIFURL}}, <a href="{{.}}">gif</a>{{end}}
+          {{- with index .Result.Sizes "gif"}} {{size .}}{{end}}
+        </div>
+      </li>
+      {{end}}
+    </ul>
+    <p>
+      {{if .Prev}}<a href="/?page={{.Prev}}">newer</a>{{end}}
+      {{if .Next}}<a href="/?page={{.Next}}">older</a>{{end}}
+    </p>
+  </body>
+</html>
+`))
+
+type GalleryPage struct {
+	Conversions []conversion
+	Total       int
+	Page        int
+	Pages       int
+	Prev        int
+	Next        int
+	APIKeys     bool
+	Syncing     bool
+}
+
+// rootHandler serves a page of the most recent conversions, newest first,
+// with a form for converting another. Until the metadata store has been
+// synced the page says it's incomplete.
+func rootHandler(w http.ResponseWriter, r *http.Request) {
+	page := 1
+	if p := r.URL.Query().Get("page"); p != "" {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 1 {
+			serveErrorStatus(w, r, fmt.Sprintf("invalid page %q", p), http.StatusBadRequest)
+			return
+		}
+		page = n
+	}
+
+	conversions, total := store.recentConversions((page-1)*galleryPageSize, galleryPageSize)
+	pages := (total + galleryPageSize - 1) / galleryPageSize
+	if pages == 0 {
+		pages = 1
+	}
+	data := GalleryPage{
+		Conversions: conversions,
+		Total:       total,
+		Page:        page,
+		Pages:       pages,
+		APIKeys:     apiClients != nil,
+		Syncing:     store.shared && store.lastSynced().IsZero(),
+	}
+	if page > 1 {
+		data.Prev = page - 1
+	}
+	if page < pages {
+		data.Next = page + 1
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := galleryTemplate.Execute(w, data); err != nil {
+		requestLogger(r).error("rendering gallery failed", "error", err)
+	}
+}
+
+// formatSize formats a number of bytes for people, or a dash for sizes
+// that weren't recorded, since older conversions don't have them.
+func formatSize(bytes int64) string {
+	switch {
+	case bytes <= 0:
+		return "-"
+	case bytes < 1024:
+		return fmt.Sprintf("%d B", bytes)
+	case bytes < 1024*1024:
+		return fmt.Sprintf("%.1f KB", float64(bytes)/1024)
+	default:
+		return fmt.Sprintf("%.1f MB", float64(bytes)/(1024*1024))
+	}
+}
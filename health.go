@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// jobSlots limits how many conversions run at once. Conversions wait for a
+// slot in convertGIF, and are counted in jobsQueued while they do.
+var jobSlots chan struct{}
+var jobsQueued int64
+
+func acquireJobSlot() {
+	atomic.AddInt64(&jobsQueued, 1)
+	jobSlots <- struct{}{}
+	atomic.AddInt64(&jobsQueued, -1)
+	atomic.AddInt64(&jobsInFlight, 1)
+}
+
+func releaseJobSlot() {
+	atomic.AddInt64(&jobsInFlight, -1)
+	<-jobSlots
+}
+
+// checkBucketAccess looks for a tombstone that doesn't exist, the way every
+// upload does. Without s3:ListBucket, S3 answers that with a 403 rather than
+// a 404, and every upload would fail.
+func checkBucketAccess() error {
+	_, _, err := getObject(tombstoneKey(strings.Repeat("0", 32)))
+	if err != nil {
+		return errors.New(fmt.Sprintf("%v; the credentials need s3:GetObject and s3:ListBucket on the bucket", err))
+	}
+	return nil
+}
+
+type healthCheck struct {
+	OK    bool        `json:"ok"`
+	Error string      `json:"error,omitempty"`
+	Info  interface{} `json:"info,omitempty"`
+}
+
+type ReadinessResult struct {
+	Ready  bool                   `json:"ready"`
+	Checks map[string]healthCheck `json:"checks"`
+}
+
+func check(err error, info interface{}) healthCheck {
+	if err != nil {
+		return healthCheck{OK: false, Error: err.Error(), Info: info}
+	}
+	return healthCheck{OK: true, Info: info}
+}
+
+func checkBinary(path string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return exec.CommandContext(ctx, path, "-version").Run()
+}
+
+func checkScratchDir() (map[string]int64, error) {
+	scratchDir := config.Scratch.Dir
+	minFree := int64(config.Scratch.MinFreeMB) * 1024 * 1024
+	f, err := ioutil.TempFile(scratchDir, ".readyz")
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(scratchDir, &stat); err != nil {
+		return nil, err
+	}
+	free := int64(uint64(stat.Bavail) * uint64(stat.Bsize))
+	info := map[string]int64{"free_bytes": free, "min_free_bytes": minFree}
+	if free < minFree {
+		return info, errors.New(fmt.Sprintf("only %d bytes free in %v", free, scratchDir))
+	}
+	return info, nil
+}
+
+func checkWorkers() (map[string]int64, error) {
+	running := atomic.LoadInt64(&jobsInFlight)
+	queued := atomic.LoadInt64(&jobsQueued)
+	info := map[string]int64{"running": running, "queued": queued, "max": int64(config.MaxConcurrentJobs)}
+	if running >= int64(config.MaxConcurrentJobs) {
+		return info, errors.New(fmt.Sprintf("all %d workers are busy", config.MaxConcurrentJobs))
+	}
+	return info, nil
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"ok":true}`))
+}
+
+// readyzHandler reports whether this instance can take conversions right
+// now, with a breakdown of each check. It's a 503 if any check fails.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	result := ReadinessResult{Ready: true, Checks: map[string]healthCheck{}}
+	if isDraining() {
+		result.Checks["shutdown"] = check(errShuttingDown, nil)
+	}
+	result.Checks["ffmpeg"] = check(checkBinary(config.FFmpegPath), nil)
+	result.Checks["convert"] = check(checkBinary(config.ConvertPath), nil)
+	scratchInfo, err := checkScratchDir()
+	result.Checks["scratch"] = check(err, scratchInfo)
+	_, err = s3Keys()
+	result.Checks["s3_credentials"] = check(err, nil)
+	result.Checks["s3_access"] = check(checkBucketAccess(), nil)
+	workersInfo, err := checkWorkers()
+	result.Checks["workers"] = check(err, workersInfo)
+
+	for _, c := range result.Checks {
+		if !c.OK {
+			result.Ready = false
+		}
+	}
+
+	js, err := json.Marshal(result)
+	if err != nil {
+		serveError(w, r, err.Error())
+		return
+	}
+	if !result.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(js)
+}
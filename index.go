@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var indexTemplate *template.Template
+
+type IndexPage struct {
+	URLCount int
+}
+
+func renderIndex() ([]byte, error) {
+	var b bytes.Buffer
+	err := indexTemplate.Execute(&b, IndexPage{URLCount: store.count()})
+	return b.Bytes(), err
+}
+
+// indexPublisher renders the index page and uploads it to the bucket, for
+// the bucket's website index document. It's published every
+// index.publish_interval and after every index.publish_every uploads, but
+// only once the metadata store has been synced, since until then it only
+// has this server's conversions.
+type indexPublisher struct {
+	uploads    int64
+	publishing int32
+	synced     int32
+}
+
+// index is only set while serving, so the commands never publish.
+var index *indexPublisher
+
+func newIndexPublisher() *indexPublisher {
+	p := &indexPublisher{}
+	if interval := time.Duration(config.Index.PublishInterval); interval > 0 {
+		go func() {
+			for range time.Tick(interval) {
+				p.publish()
+			}
+		}()
+	}
+	return p
+}
+
+func (p *indexPublisher) uploaded() {
+	if p == nil || config.Index.PublishEvery == 0 {
+		return
+	}
+	if atomic.AddInt64(&p.uploads, 1)%int64(config.Index.PublishEvery) == 0 {
+		go p.publish()
+	}
+}
+
+// storeSynced is called after each sync of the metadata store, and
+// publishes the page after the first one.
+func (p *indexPublisher) storeSynced() {
+	if atomic.CompareAndSwapInt32(&p.synced, 0, 1) && config.Index.PublishInterval > 0 {
+		p.publish()
+	}
+}
+
+// publish skips publishing if it's already being published, since the page
+// would be the same.
+func (p *indexPublisher) publish() {
+	if atomic.LoadInt32(&p.synced) == 0 || !atomic.CompareAndSwapInt32(&p.publishing, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&p.publishing, 0)
+
+	log := rootLogger.with("key", config.Index.Key)
+	if err := publishIndex(log); err != nil {
+		log.error("publishing index page failed", "error", err)
+	}
+}
+
+func publishIndex(log *logger) error {
+	page, err := renderIndex()
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "text/html; charset=utf-8")
+	header.Set("Cache-Control", "public, max-age=300")
+	if err := putBytesToS3(log, page, config.Index.Key, header); err != nil {
+		return err
+	}
+	log.info("published index page", "url_count", store.count())
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	for i, name := range logLevelNames {
+		if s == name {
+			return logLevel(i), nil
+		}
+	}
+	return levelInfo, errors.New(fmt.Sprintf("must be one of %v, got %q", strings.Join(logLevelNames, ", "), s))
+}
+
+var minLogLevel = levelInfo
+var logJSON = false
+
+var logOutput io.Writer = os.Stdout
+var logOutputMu sync.Mutex
+
+// logger writes one line per message, either as logfmt or as JSON, with the
+// time, level and message followed by its fields. Fields are alternating
+// keys and values.
+type logger struct {
+	fields []interface{}
+}
+
+var rootLogger = &logger{}
+
+func (l *logger) with(fields ...interface{}) *logger {
+	return &logger{fields: append(append([]interface{}(nil), l.fields...), fields...)}
+}
+
+func (l *logger) debug(msg string, fields ...interface{}) { l.log(levelDebug, msg, fields) }
+func (l *logger) info(msg string, fields ...interface{})  { l.log(levelInfo, msg, fields) }
+func (l *logger) warn(msg string, fields ...interface{})  { l.log(levelWarn, msg, fields) }
+func (l *logger) error(msg string, fields ...interface{}) { l.log(levelError, msg, fields) }
+
+func (l *logger) log(level logLevel, msg string, fields []interface{}) {
+	if level < minLogLevel {
+		return
+	}
+	all := append([]interface{}{
+		"time", time.Now().UTC().Format(time.RFC3339Nano),
+		"level", level.String(),
+		"msg", msg,
+	}, l.fields...)
+	all = append(all, fields...)
+
+	var line string
+	if logJSON {
+		line = formatJSON(all)
+	} else {
+		line = formatLogfmt(all)
+	}
+
+	logOutputMu.Lock()
+	defer logOutputMu.Unlock()
+	io.WriteString(logOutput, line+"\n")
+}
+
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func formatLogfmt(fields []interface{}) string {
+	var parts []string
+	for i := 0; i+1 < len(fields); i += 2 {
+		v := fmt.Sprint(logValue(fields[i+1]))
+		if v == "" || strings.ContainsAny(v, " =\"\n\t") {
+			v = fmt.Sprintf("%q", v)
+		}
+		parts = append(parts, fmt.Sprint(fields[i])+"="+v)
+	}
+	return strings.Join(parts, " ")
+}
+
+func formatJSON(fields []interface{}) string {
+	var parts []string
+	for i := 0; i+1 < len(fields); i += 2 {
+		k, _ := json.Marshal(fmt.Sprint(fields[i]))
+		v, err := json.Marshal(logValue(fields[i+1]))
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(fields[i+1]))
+		}
+		parts = append(parts, string(k)+":"+string(v))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+type loggerKey struct{}
+
+func requestLogger(r *http.Request) *logger {
+	if l, ok := r.Context().Value(loggerKey{}).(*logger); ok {
+		return l
+	}
+	return rootLogger
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 200 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// withRequestLogging gives each request a logger carrying its request id,
+// taken from the X-Request-Id header (which the Heroku router sets) or made
+// up, and returns the id in the response. Each request is logged when it's
+// finished.
+func withRequestLogging(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-Id", id)
+
+		l := rootLogger.with("request_id", id)
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		h.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), loggerKey{}, l)))
+		l.info("request", "method", r.Method, "path", r.URL.Path, "status", recorder.status, "duration", time.Since(start))
+	})
+}
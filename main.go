@@ -6,118 +6,240 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"html/template"
 	"image"
 	_ "image/gif"
 	"io"
 	"log"
+	"math"
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
-
-	"github.com/rlmcpherson/s3gof3r"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
-var bucketName = os.Getenv("S3_BUCKET_NAME")
-var bucketHost = os.Getenv("S3_BUCKET_HOST")
-
 type JSONError struct {
 	Error string `json:"error"`
 }
 
 type UploadResult struct {
-	MP4URL  string `json:"mp4url"`
-	WEBMURL string `json:"webmurl"`
-	PNGURL  string `json:"jpgurl"`
-	Width   int    `json:"width"`
-	Height  int    `json:"height"`
+	MP4URL          string             `json:"mp4url"`
+	WEBMURL         string             `json:"webmurl"`
+	PNGURL          string             `json:"jpgurl"`
+	GIFURL          string             `json:"gifurl,omitempty"`
+	OptimizedGIFURL string             `json:"optimizedgifurl,omitempty"`
+	Width           int                `json:"width"`
+	Height          int                `json:"height"`
+	SHA256          map[string]string  `json:"sha256"`
+	Sizes           map[string]int64   `json:"sizes,omitempty"`
+	Savings         map[string]float64 `json:"savings,omitempty"`
 }
 
 func main() {
-	port := flag.String("port", "9090", "the port to bind to")
-	flag.Parse()
+	command, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	var err error
+	switch command {
+	case "serve":
+		err = serveCommand(args)
+	case "convert":
+		err = convertCommand(args)
+	case "reencode":
+		err = reencodeCommand(args)
+	case "audit":
+		err = auditCommand(args)
+	default:
+		err = errors.New(fmt.Sprintf("unknown command %q, expected serve, convert, reencode or audit", command))
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func serveCommand(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	c, err := loadConfig(flags, args)
+	if err != nil {
+		return err
+	}
+	if err := c.validate(true); err != nil {
+		return err
+	}
+	useConfig(c)
+	rootLogger.info("config", c.logFields()...)
+
+	err = os.MkdirAll(config.Scratch.Dir, 0755)
+	if err != nil {
+		return err
+	}
+	store, err = openSharedStore()
+	if err != nil {
+		return err
+	}
+	indexTemplate, err = template.ParseFiles(config.Index.Template)
+	if err != nil {
+		return err
+	}
+	index = newIndexPublisher()
+	syncStorePeriodically(index.storeSynced)
+	if config.APIKeysPath != "" {
+		apiClients, err = loadAPIKeys(config.APIKeysPath)
+		if err != nil {
+			return err
+		}
+	} else {
+		rootLogger.warn("api_keys_path (API_KEYS_PATH) is not set, /upload is open to everyone")
+	}
 
 	r := mux.NewRouter()
 
 	r.Handle("/", http.HandlerFunc(rootHandler))
 	r.Handle("/upload", http.HandlerFunc(uploadHandler))
+	r.Handle("/upload/events", http.HandlerFunc(uploadEventsHandler))
+	r.Handle("/batch", http.HandlerFunc(batchHandler)).Methods("POST")
+	r.Handle("/admin/usage", http.HandlerFunc(usageHandler))
+	r.Handle("/metrics", http.HandlerFunc(metricsHandler))
+	r.Handle("/healthz", http.HandlerFunc(healthzHandler))
+	r.Handle("/readyz", http.HandlerFunc(readyzHandler))
+	r.Handle("/gifs", http.HandlerFunc(deleteHandler)).Methods("DELETE")
+	r.Handle("/gifs/{hash}", http.HandlerFunc(deleteHandler)).Methods("DELETE")
+	r.Handle("/oembed", http.HandlerFunc(oembedHandler))
+	r.Handle("/embed/{hash}", http.HandlerFunc(embedHandler))
 	r.Handle("/{asset}", http.HandlerFunc(assetHandler))
-	http.Handle("/", r)
-	fmt.Printf("Starting on port %v...\n", *port)
+	http.Handle("/", withRequestLogging(r))
+	rootLogger.info("starting", "port", config.Port)
 
-	err := http.ListenAndServe("0.0.0.0:"+*port, nil)
-	log.Fatal(err)
+	return serveUntilShutdown("0.0.0.0:" + config.Port)
 }
 
-func downloadFile(gifURL string) (string, error) {
+var downloadClient = &http.Client{
+	Timeout:       60 * time.Second,
+	CheckRedirect: checkRedirect,
+	Transport: &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		Dial:                dialPublic,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+func downloadFile(log *logger, gifURL string, progress progressFunc) (string, error) {
 	outputPath := outputPath(gifURL, "gif")
 	if _, err := os.Stat(outputPath); err == nil {
 		return outputPath, nil
 	}
 
-	file, err := os.Create(outputPath)
+	_, err := config.Download.Retry.do(log, func() error {
+		return fetchFile(gifURL, outputPath, progress)
+	})
 	if err != nil {
+		os.Remove(outputPath)
 		return "", err
 	}
-	defer file.Close()
+	return outputPath, nil
+}
 
-	response, err := http.Get(gifURL)
+func fetchFile(gifURL string, outputPath string, progress progressFunc) error {
+	response, err := downloadClient.Get(gifURL)
 	if err != nil {
-		return "", err
+		if isTransientNetworkError(err) {
+			return retryable(err)
+		}
+		return err
 	}
 	defer response.Body.Close()
+	if response.StatusCode >= 500 {
+		return retryable(errors.New(fmt.Sprintf("%q returned %v", gifURL, response.Status)))
+	}
+	if response.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("%q returned %v", gifURL, response.Status))
+	}
 	if response.Header.Get("Content-Type") != "image/gif" {
-		return "", errors.New(fmt.Sprintf("%q is not an image/gif", gifURL))
+		return errors.New(fmt.Sprintf("%q is not an image/gif", gifURL))
 	}
 
-	_, err = io.Copy(file, response.Body)
+	file, err := os.Create(outputPath)
 	if err != nil {
-		return "", err
+		return err
 	}
-	return file.Name(), nil
+	defer file.Close()
+
+	_, err = io.Copy(file, &downloadProgressReader{r: response.Body, total: response.ContentLength, progress: progress})
+	if err != nil {
+		if isTransientNetworkError(err) {
+			return retryable(err)
+		}
+		return err
+	}
+	return nil
 }
 
-func outputPath(gifURL string, extension string) string {
+func urlHash(gifURL string) string {
 	h := md5.New()
 	io.WriteString(h, gifURL)
-	return fmt.Sprintf("%x", h.Sum(nil)) + "." + extension
+	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
-func convertFile(gifURL string, gifPath string, videoExtension string) (string, error) {
-	videoPath := outputPath(gifURL, videoExtension)
+func outputPath(gifURL string, extension string) string {
+	return scratchPath(urlHash(gifURL), extension)
+}
+
+func scratchPath(hash string, extension string) string {
+	return filepath.Join(config.Scratch.Dir, hash+"."+extension)
+}
+
+// renditionPath is where r is written in the scratch directory. The gif
+// rendition can't go in hash.gif, since that's where the original is
+// downloaded to.
+func renditionPath(hash string, r rendition) string {
+	if r == optimizedGIFRendition {
+		return scratchPath(hash, "optimized.gif")
+	}
+	return scratchPath(hash, r.Extension)
+}
+
+func convertFile(log *logger, gifURL string, gifPath string, r rendition, progress progressFunc) (string, error) {
+	videoExtension := r.Extension
+	videoPath := renditionPath(urlHash(gifURL), r)
 	if _, err := os.Stat(videoPath); err == nil {
 		return videoPath, nil
 	}
 
 	if videoExtension == "jpg" {
 		o, err := exec.Command(
-			"convert",
+			config.ConvertPath,
 			gifPath+"[0]",
 			videoPath,
 		).CombinedOutput()
 		if err != nil {
-			fmt.Println(string(o))
+			log.error("conversion failed", "extension", videoExtension, "error", err, "output", string(o))
 			return "", err
 		}
+		conversionProgress(progress, videoExtension)(100)
 		return videoPath, nil
 	} else if videoExtension == "webm" {
-		o, err := exec.Command(
-			"vendor/ffmpeg-2.7-64bit-static/ffmpeg",
+		o, err := runFFmpeg(
+			conversionProgress(progress, videoExtension),
 			"-i", gifPath,
 			"-y",
 			"-b:v", "5M",
 			videoPath,
-		).CombinedOutput()
+		)
 		if err != nil {
-			fmt.Println(string(o))
+			log.error("conversion failed", "extension", videoExtension, "error", err, "output", string(o))
 			return "", err
 		}
 		return videoPath, nil
 	} else if videoExtension == "mp4" {
-		o, err := exec.Command(
-			"vendor/ffmpeg-2.7-64bit-static/ffmpeg",
+		o, err := runFFmpeg(
+			conversionProgress(progress, videoExtension),
 			"-i", gifPath,
 			"-y",
 			"-vcodec", "libx264",
@@ -129,9 +251,28 @@ func convertFile(gifURL string, gifPath string, videoExtension string) (string,
 			"-pass", "1",
 			"-strict", "experimental",
 			videoPath,
-		).CombinedOutput()
+		)
+		if err != nil {
+			log.error("conversion failed", "extension", videoExtension, "error", err, "output", string(o))
+			return "", err
+		}
+		return videoPath, nil
+	} else if videoExtension == "gif" {
+		// One palette made for the whole gif, after cutting the frame rate
+		// and capping the width, which are what make gifs big.
+		filters := fmt.Sprintf(
+			"fps=%d,scale='min(%d,iw)':-1:flags=lanczos,split[a][b];[a]palettegen[p];[b][p]paletteuse",
+			config.GIF.FPS, config.GIF.MaxWidth,
+		)
+		o, err := runFFmpeg(
+			conversionProgress(progress, videoExtension),
+			"-i", gifPath,
+			"-y",
+			"-filter_complex", filters,
+			videoPath,
+		)
 		if err != nil {
-			fmt.Println(string(o))
+			log.error("conversion failed", "extension", videoExtension, "error", err, "output", string(o))
 			return "", err
 		}
 		return videoPath, nil
@@ -154,146 +295,403 @@ func getImageDimensions(imagePath string) (int, int, error) {
 	return image.Width, image.Height, nil
 }
 
-func rootHandler(w http.ResponseWriter, r *http.Request) {
-	w.Write([]byte("gifs?"))
-}
-
 func assetHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireSignature(w, r) {
+		return
+	}
 	asset := mux.Vars(r)["asset"]
-	http.Redirect(w, r, "https://s3.amazonaws.com/ancientcitadelgifs/"+asset, http.StatusTemporaryRedirect)
+	if hashPattern.MatchString(asset) {
+		negotiateAsset(w, r, asset)
+		return
+	}
+	key := asset
+	if i := strings.LastIndex(asset, "."); i != -1 {
+		if rendition, ok := renditionForExtension(asset[i+1:]); ok {
+			key = objectKey(asset[:i], rendition)
+		}
+	}
+	http.Redirect(w, r, objectURL(key), http.StatusTemporaryRedirect)
+}
+
+// negotiateAsset redirects a request for a hash with no extension to the
+// rendition that suits the client best, or to the original gif when it asks
+// for image/gif. That's the archived copy if there is one, or else the url
+// it was converted from.
+func negotiateAsset(w http.ResponseWriter, r *http.Request, hash string) {
+	w.Header().Set("Vary", "Accept, User-Agent")
+	candidates := renditions
+	c, _ := store.conversion(hash)
+	gifURL := c.Result.GIFURL
+	if gifURL == "" && !strings.HasPrefix(c.SourceURL, "file://") {
+		gifURL = c.SourceURL
+	}
+	if gifURL != "" {
+		candidates = append(candidates[:len(candidates):len(candidates)], originalRendition)
+	}
+	rendition, ok := negotiateRendition(r.Header.Get("Accept"), r.Header.Get("User-Agent"), candidates)
+	if !ok {
+		serveErrorStatus(w, r, "none of the renditions are acceptable", http.StatusNotAcceptable)
+		return
+	}
+	if rendition == originalRendition {
+		http.Redirect(w, r, gifURL, http.StatusTemporaryRedirect)
+		return
+	}
+	http.Redirect(w, r, objectURL(objectKey(hash, rendition)), http.StatusTemporaryRedirect)
+}
+
+func serveError(w http.ResponseWriter, r *http.Request, e string) {
+	serveErrorStatus(w, r, e, http.StatusInternalServerError)
 }
 
-func serveError(w http.ResponseWriter, e string) {
+func serveErrorStatus(w http.ResponseWriter, r *http.Request, e string, status int) {
 	b, _ := json.Marshal(JSONError{Error: e})
 	w.Header().Set("Content-Type", "application/json")
-	log.Println("error: " + e)
-	http.Error(w, string(b), http.StatusInternalServerError)
+	requestLogger(r).error("request failed", "error", e, "status", status)
+	http.Error(w, string(b), status)
 }
 
-func putToS3(path string) error {
-	file, err := os.Open(path)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
+type removedError struct {
+	gifURL string
+}
 
-	keys, err := s3gof3r.EnvKeys()
-	if err != nil {
-		return err
-	}
+func (e removedError) Error() string {
+	return fmt.Sprintf("%q has been removed and can't be converted again", e.gifURL)
+}
 
-	contentTypes := map[string]string{
-		".webm": "video/webm",
-		".mp4":  "video/mp4",
-		".jpg":  "image/jpeg",
+func errorStatus(err error) int {
+	if isSourceRejected(err) {
+		return http.StatusForbidden
 	}
-	header := http.Header{}
-	for e, t := range contentTypes {
-		if strings.HasSuffix(path, e) {
-			header.Set("Content-Type", t)
-			break
-		}
+	if _, ok := err.(removedError); ok {
+		return http.StatusGone
+	}
+	if err == errShuttingDown {
+		return http.StatusServiceUnavailable
 	}
-	header.Set("Cache-Control", "max-age=86400")
+	return http.StatusInternalServerError
+}
 
-	s3 := s3gof3r.New("", keys)
-	bucket := s3.Bucket(bucketName)
-	writer, err := bucket.PutWriter(path, header, nil)
-	if err != nil {
+func checkGIFURL(gifURL string) error {
+	if isDraining() {
+		return errShuttingDown
+	}
+	if err := checkSource(gifURL); err != nil {
+		recordUpload("check", err)
 		return err
 	}
-	defer writer.Close()
-
-	_, err = io.Copy(writer, file)
+	_, removed, err := findTombstone(urlHash(gifURL))
+	if err == nil && removed {
+		err = removedError{gifURL}
+	}
 	if err != nil {
+		recordUpload("check", err)
 		return err
 	}
-
 	return nil
 }
 
-func uploadHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+// conversionOptions change what happens to each rendition once it's been
+// converted. By default it's uploaded, recorded in the store and removed.
+type conversionOptions struct {
+	// OutputDir, when set, is where renditions are kept.
+	OutputDir string
+	// SkipUpload leaves renditions where they are, and gives their paths in
+	// the UploadResult instead of urls. Nothing is recorded in the store.
+	SkipUpload bool
+	// CacheControl, when set, replaces the Cache-Control renditions are
+	// uploaded with.
+	CacheControl string
+}
 
-	gifURL := r.URL.Query().Get("u")
-	if gifURL == "" {
-		serveError(w, "please specify a file to download")
-		return
+// convertGIF downloads, converts and uploads gifURL. progress, which may be
+// nil, is told about each stage as it happens.
+func convertGIF(log *logger, gifURL string, progress progressFunc) (UploadResult, error) {
+	return runConversion(log, gifURL, progress, conversionOptions{})
+}
+
+// hashLocks stops two conversions of the same url running at once, since
+// they'd download and convert to the same scratch paths.
+var hashLocks = struct {
+	sync.Mutex
+	locks map[string]*hashLock
+}{locks: map[string]*hashLock{}}
+
+type hashLock struct {
+	sync.Mutex
+	waiters int
+}
+
+func lockHash(hash string) {
+	hashLocks.Lock()
+	l, ok := hashLocks.locks[hash]
+	if !ok {
+		l = &hashLock{}
+		hashLocks.locks[hash] = l
 	}
+	l.waiters++
+	hashLocks.Unlock()
+	l.Lock()
+}
+
+func unlockHash(hash string) {
+	hashLocks.Lock()
+	l := hashLocks.locks[hash]
+	l.waiters--
+	if l.waiters == 0 {
+		delete(hashLocks.locks, hash)
+	}
+	hashLocks.Unlock()
+	l.Unlock()
+}
+
+func runConversion(log *logger, gifURL string, progress progressFunc, opts conversionOptions) (result UploadResult, err error) {
+	hash := urlHash(gifURL)
+	log = log.with("url", gifURL, "hash", hash)
 
-	fmt.Printf("downloading %q...\n", gifURL)
-	gifPath, err := downloadFile(gifURL)
+	lockHash(hash)
+	defer unlockHash(hash)
+	acquireJobSlot()
+	defer releaseJobSlot()
+	stage := "check"
+	defer func() { recordUpload(stage, err) }()
+
+	// It may have been deleted while this was waiting for the lock.
+	if !opts.SkipUpload {
+		_, removed, err := findTombstone(hash)
+		if err != nil {
+			return UploadResult{}, err
+		}
+		if removed {
+			return UploadResult{}, removedError{gifURL}
+		}
+	}
+
+	stage = "download"
+
+	log.info("downloading")
+	progress.report(progressEvent{Stage: "downloading"})
+	start := time.Now()
+	gifPath, err := downloadFile(log, gifURL, progress)
 	if err != nil {
-		serveError(w, err.Error())
-		return
+		return UploadResult{}, err
 	}
+	downloadDuration.since(start)
 	fi, err := os.Stat(gifPath)
 	if err != nil {
-		serveError(w, err.Error())
-		return
+		return UploadResult{}, err
 	}
-	fmt.Printf("downloaded %d bytes...\n", fi.Size())
+	downloadBytes.observe(float64(fi.Size()))
+	log.info("downloaded", "bytes", fi.Size())
 
+	stage = "convert"
 	width, height, err := getImageDimensions(gifPath)
 	if err != nil {
-		serveError(w, "error getting dimensions "+err.Error())
-		return
+		return UploadResult{}, errors.New("error getting dimensions " + err.Error())
 	}
 
-	var videosToUpload []string
-	for _, extension := range []string{"webm", "mp4", "jpg"} {
-		fmt.Printf("converting %q to %v...\n", gifPath, extension)
-
-		videoPath, err := convertFile(gifURL, gifPath, extension)
+	urls := map[string]string{}
+	keys := map[string]string{}
+	checksums := map[string]string{}
+	sizes := map[string]int64{originalRendition.Name: fi.Size()}
+	for _, rendition := range renditions {
+		stage = "convert"
+		log.info("converting", "extension", rendition.Extension)
+		progress.report(progressEvent{Stage: "converting", Extension: rendition.Extension})
+
+		start := time.Now()
+		videoPath, err := convertFile(log, gifURL, gifPath, rendition, progress)
 		if err != nil {
-			serveError(w, err.Error())
-			return
+			return UploadResult{}, err
+		}
+		conversionDuration.since(start, rendition.Extension)
+		if fi, err := os.Stat(videoPath); err == nil {
+			outputBytes.observe(float64(fi.Size()), rendition.Extension)
+			sizes[rendition.Extension] = fi.Size()
 		}
 
-		videosToUpload = append(videosToUpload, videoPath)
+		checksum, err := fileSHA256(videoPath)
+		if err != nil {
+			return UploadResult{}, err
+		}
+		meta := objectMetadata{SourceURL: gifURL, Width: width, Height: height, SHA256: checksum}
+
+		key := objectKey(hash, rendition)
+		if !opts.SkipUpload {
+			stage = "upload"
+			log.info("uploading", "extension", rendition.Extension, "key", key)
+			progress.report(progressEvent{Stage: "uploading", Extension: rendition.Extension, Key: key})
+			start = time.Now()
+			header := objectHeader(rendition, meta)
+			if opts.CacheControl != "" {
+				header.Set("Cache-Control", opts.CacheControl)
+			}
+			err = putToS3(log, videoPath, key, header)
+			if err != nil {
+				return UploadResult{}, err
+			}
+			s3UploadDuration.since(start, rendition.Extension)
+			urls[rendition.Extension] = objectURL(key)
+			keys[rendition.Extension] = key
+		}
+		checksums[rendition.Extension] = checksum
+
+		if opts.OutputDir != "" {
+			outputPath := filepath.Join(opts.OutputDir, filepath.Base(videoPath))
+			err = moveFile(videoPath, outputPath)
+			if err != nil {
+				return UploadResult{}, err
+			}
+			if opts.SkipUpload {
+				urls[rendition.Extension] = outputPath
+			}
+		} else {
+			err = os.Remove(videoPath)
+			if err != nil {
+				return UploadResult{}, err
+			}
+		}
 	}
 
-	for _, videoPath := range videosToUpload {
-		fmt.Printf("uploading %q to S3...\n", videoPath)
-		err = putToS3(videoPath)
+	var original *archivedOriginal
+	if config.S3.Archive.Enabled && !opts.SkipUpload {
+		stage = "upload"
+		checksum, err := fileSHA256(gifPath)
 		if err != nil {
-			serveError(w, err.Error())
-			return
+			return UploadResult{}, err
 		}
-		err = os.Remove(videoPath)
+		bucketName, bucketHost := config.S3.archiveBucket()
+		key := archiveKey(hash)
+		log.info("archiving", "bucket", bucketName, "key", key)
+		progress.report(progressEvent{Stage: "uploading", Extension: originalRendition.Name, Key: key})
+		start := time.Now()
+		meta := objectMetadata{SourceURL: gifURL, Width: width, Height: height, SHA256: checksum}
+		err = putToBucket(log, bucketName, gifPath, key, objectHeader(originalRendition, meta))
 		if err != nil {
-			serveError(w, err.Error())
-			return
+			return UploadResult{}, err
 		}
+		s3UploadDuration.since(start, originalRendition.Name)
+		original = &archivedOriginal{Bucket: bucketName, Key: key}
+		urls[originalRendition.Name] = bucketHost + "/" + key
+		checksums[originalRendition.Name] = checksum
 	}
 
 	err = os.Remove(gifPath)
 	if err != nil {
-		serveError(w, err.Error())
+		return UploadResult{}, err
+	}
+
+	stage = "store"
+	uploadResult := UploadResult{
+		MP4URL:          urls["mp4"],
+		WEBMURL:         urls["webm"],
+		PNGURL:          urls["jpg"],
+		GIFURL:          urls[originalRendition.Name],
+		OptimizedGIFURL: urls["gif"],
+		Width:           width,
+		Height:          height,
+		SHA256:          checksums,
+		Sizes:           sizes,
+		Savings:         sizeSavings(sizes),
+	}
+	if opts.SkipUpload {
+		log.info("converted")
+		return uploadResult, nil
+	}
+
+	err = store.recordConversion(conversion{
+		Hash:      hash,
+		SourceURL: gifURL,
+		Keys:      keys,
+		Result:    uploadResult,
+		Original:  original,
+		CreatedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return UploadResult{}, err
+	}
+	index.uploaded()
+	log.info("converted")
+	return uploadResult, nil
+}
+
+// sizeSavings is how much smaller than the original each of the video and
+// gif renditions is, as a percentage. The poster is a single frame, so it
+// isn't a saving.
+func sizeSavings(sizes map[string]int64) map[string]float64 {
+	original := sizes[originalRendition.Name]
+	if original <= 0 {
+		return nil
+	}
+	savings := map[string]float64{}
+	for _, extension := range []string{"mp4", "webm", optimizedGIFRendition.Extension} {
+		size, ok := sizes[extension]
+		if !ok {
+			continue
+		}
+		saving := 100 * (1 - float64(size)/float64(original))
+		savings[extension] = math.Floor(saving*10+0.5) / 10
+	}
+	return savings
+}
+
+func uploadHandler(w http.ResponseWriter, r *http.Request) {
+	log := requestLogger(r)
+	w.Header().Set("Content-Type", "application/json")
+	if !requireSignature(w, r) {
+		return
+	}
+	client, ok := authenticateClient(w, r, 1)
+	if !ok {
 		return
 	}
 
-	mp4Path := strings.TrimSuffix(gifPath, ".gif") + ".mp4"
-	webmPath := strings.TrimSuffix(gifPath, ".gif") + ".webm"
-	jpgPath := strings.TrimSuffix(gifPath, ".gif") + ".jpg"
+	gifURL := r.URL.Query().Get("u")
+	if gifURL == "" {
+		client.refund(1)
+		serveError(w, r, "please specify a file to download")
+		return
+	}
+	if err := checkGIFURL(gifURL); err != nil {
+		client.refund(1)
+		serveErrorStatus(w, r, err.Error(), errorStatus(err))
+		return
+	}
 
-	uploadResult := UploadResult{
-		MP4URL:  bucketHost + "/" + mp4Path,
-		WEBMURL: bucketHost + "/" + webmPath,
-		PNGURL:  bucketHost + "/" + jpgPath,
-		Width:   width,
-		Height:  height,
+	if callbackURL := r.URL.Query().Get("callback"); callbackURL != "" {
+		if err := checkCallbackURL(callbackURL); err != nil {
+			client.refund(1)
+			serveErrorStatus(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		goBackground(func() {
+			uploadResult, err := convertGIF(log, gifURL, nil)
+			if err != nil {
+				client.refund(1)
+			}
+			deliverCallback(log, callbackURL, gifURL, uploadResult, err)
+		})
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"status":"accepted"}`))
+		return
+	}
+
+	uploadResult, err := convertGIF(log, gifURL, nil)
+	if err != nil {
+		client.refund(1)
+		serveErrorStatus(w, r, err.Error(), errorStatus(err))
+		return
 	}
 
 	js, err := json.Marshal(uploadResult)
 	if err != nil {
-		serveError(w, err.Error())
+		serveError(w, r, err.Error())
 		return
 	}
 
 	_, err = w.Write(js)
 	if err != nil {
-		serveError(w, err.Error())
+		serveError(w, r, err.Error())
 		return
 	}
 }
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSizeSavings(t *testing.T) {
+	tests := []struct {
+		sizes map[string]int64
+		want  map[string]float64
+	}{
+		{
+			map[string]int64{"original": 1000, "webm": 250, "mp4": 400, "jpg": 50},
+			map[string]float64{"webm": 75, "mp4": 60},
+		},
+		{
+			map[string]int64{"original": 1000, "webm": 250, "mp4": 400, "gif": 600, "jpg": 50},
+			map[string]float64{"webm": 75, "mp4": 60, "gif": 40},
+		},
+		{
+			map[string]int64{"original": 3, "webm": 1, "mp4": 2},
+			map[string]float64{"webm": 66.7, "mp4": 33.3},
+		},
+		{
+			map[string]int64{"original": 1000, "webm": 1500, "mp4": 1000},
+			map[string]float64{"webm": -50, "mp4": 0},
+		},
+		{
+			map[string]int64{"original": 1000, "jpg": 50},
+			map[string]float64{},
+		},
+		{map[string]int64{"webm": 250, "mp4": 400}, nil},
+		{map[string]int64{"original": 0, "webm": 250}, nil},
+		{nil, nil},
+	}
+	for _, test := range tests {
+		if got := sizeSavings(test.sizes); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("sizeSavings(%v) = %v, want %v", test.sizes, got, test.want)
+		}
+	}
+}
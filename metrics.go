@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metric is anything that can write itself in the Prometheus text format.
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+var metrics []metric
+
+func register(m metric) {
+	metrics = append(metrics, m)
+}
+
+type metricDesc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (d metricDesc) header(w io.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, kind)
+}
+
+// labelString formats label values for a series, with extra pairs (like le
+// for histogram buckets) added on the end.
+func (d metricDesc) labelString(values []string, extra ...string) string {
+	var pairs []string
+	for i, label := range d.labels {
+		pairs = append(pairs, label+"="+strconv.Quote(values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+strconv.Quote(extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+type counterVec struct {
+	metricDesc
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name string, help string, labels ...string) *counterVec {
+	c := &counterVec{metricDesc: metricDesc{name, help, labels}, values: map[string]float64{}}
+	register(c)
+	return c
+}
+
+func (c *counterVec) add(v float64, labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[strings.Join(labelValues, "\x00")] += v
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.header(w, "counter")
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %v\n", c.name, c.labelString(splitLabels(key)), c.values[key])
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	metricDesc
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogram
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{metricDesc: metricDesc{name, help, labels}, buckets: buckets, series: map[string]*histogram{}}
+	register(h)
+	return h
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := strings.Join(labelValues, "\x00")
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) since(start time.Time, labelValues ...string) {
+	h.observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header(w, "histogram")
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		values := splitLabels(key)
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(values, "le", formatFloat(upper)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(values, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %v\n", h.name, h.labelString(values), s.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelString(values), s.count)
+	}
+}
+
+// gaugeFunc is a gauge whose value is worked out when it's scraped.
+type gaugeFunc struct {
+	metricDesc
+	value func() float64
+}
+
+func newGaugeFunc(name string, help string, value func() float64) *gaugeFunc {
+	g := &gaugeFunc{metricDesc: metricDesc{name: name, help: help}, value: value}
+	register(g)
+	return g
+}
+
+func (g *gaugeFunc) writeTo(w io.Writer) {
+	g.header(w, "gauge")
+	fmt.Fprintf(w, "%s %v\n", g.name, g.value())
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func splitLabels(key string) []string {
+	return strings.Split(key, "\x00")
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func exponentialBuckets(start float64, factor float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start * math.Pow(factor, float64(i))
+	}
+	return buckets
+}
+
+var jobsInFlight int64
+
+var (
+	uploadsTotal = newCounterVec("gifs_uploads_total",
+		"Conversions by outcome, and by class of error when they failed.", "outcome", "error_class")
+	retriesTotal = newCounterVec("gifs_retries_total",
+		"Retries of downloads, S3 puts and callbacks.", "operation")
+	downloadBytes = newHistogramVec("gifs_download_bytes",
+		"Size of downloaded gifs.", exponentialBuckets(64*1024, 2, 10))
+	downloadDuration = newHistogramVec("gifs_download_duration_seconds",
+		"Time taken to download gifs.", exponentialBuckets(0.1, 2, 10))
+	conversionDuration = newHistogramVec("gifs_conversion_duration_seconds",
+		"Time taken to convert a gif to each rendition.", exponentialBuckets(0.1, 2, 10), "extension")
+	outputBytes = newHistogramVec("gifs_output_bytes",
+		"Size of each converted rendition.", exponentialBuckets(16*1024, 2, 12), "extension")
+	s3UploadDuration = newHistogramVec("gifs_s3_upload_duration_seconds",
+		"Time taken to put each rendition to S3.", exponentialBuckets(0.05, 2, 10), "extension")
+	_ = newGaugeFunc("gifs_jobs_in_flight",
+		"Conversions currently running.", func() float64 { return float64(atomic.LoadInt64(&jobsInFlight)) })
+	_ = newGaugeFunc("gifs_jobs_queued",
+		"Conversions waiting for a free worker.", func() float64 { return float64(atomic.LoadInt64(&jobsQueued)) })
+	_ = newGaugeFunc("gifs_scratch_disk_bytes",
+		"Bytes used by files in the scratch directory.", func() float64 { return float64(scratchDiskUsage()) })
+)
+
+func scratchDiskUsage() int64 {
+	var total int64
+	filepath.Walk(config.Scratch.Dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+// errorClass sorts a failed conversion into a bucket that's useful for
+// alerting on, based on the stage it failed at.
+func errorClass(stage string, err error) string {
+	if isSourceRejected(err) {
+		return "source_rejected"
+	}
+	if _, ok := err.(removedError); ok {
+		return "removed"
+	}
+	if _, ok := err.(integrityError); ok {
+		return "integrity"
+	}
+	return stage
+}
+
+func recordUpload(stage string, err error) {
+	if err == nil {
+		uploadsTotal.add(1, "success", "")
+		return
+	}
+	uploadsTotal.add(1, "failure", errorClass(stage, err))
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range metrics {
+		m.writeTo(w)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+type mediaRange struct {
+	Type    string
+	Subtype string
+	Q       float64
+}
+
+func parseAccept(header string) []mediaRange {
+	if strings.TrimSpace(header) == "" {
+		return []mediaRange{{"*", "*", 1}}
+	}
+	var ranges []mediaRange
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		slash := strings.Index(mediaType, "/")
+		if slash == -1 {
+			continue
+		}
+		mr := mediaRange{Type: mediaType[:slash], Subtype: mediaType[slash+1:], Q: 1}
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && strings.ToLower(kv[0]) == "q" {
+				if q, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					mr.Q = q
+				}
+			}
+		}
+		ranges = append(ranges, mr)
+	}
+	return ranges
+}
+
+// quality is the q the most specific of ranges matching contentType gives
+// it, and how specific that was: 2 for an exact match, 1 for type/* and 0
+// for */*. It's -1 if nothing matches.
+func quality(ranges []mediaRange, contentType string) (float64, int) {
+	slash := strings.Index(contentType, "/")
+	t, s := contentType[:slash], contentType[slash+1:]
+	q, specificity := 0.0, -1
+	for _, mr := range ranges {
+		var sp int
+		switch {
+		case mr.Type == t && mr.Subtype == s:
+			sp = 2
+		case mr.Type == t && mr.Subtype == "*":
+			sp = 1
+		case mr.Type == "*" && mr.Subtype == "*":
+			sp = 0
+		default:
+			continue
+		}
+		if sp > specificity {
+			q, specificity = mr.Q, sp
+		}
+	}
+	return q, specificity
+}
+
+// supportsWebM guesses from the User-Agent whether a client that accepts
+// any video can play webm. Safari, and everything on iOS since it's all
+// Safari underneath, only plays mp4.
+func supportsWebM(userAgent string) bool {
+	if !strings.Contains(userAgent, "Safari") {
+		return true
+	}
+	for _, engine := range []string{"Chrome", "Chromium", "Firefox", "Android"} {
+		if strings.Contains(userAgent, engine) {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateRendition picks the rendition of candidates, which are in order
+// of preference, the client would most like from its Accept header. webm
+// is only picked for a wildcard when the User-Agent can play it.
+func negotiateRendition(accept string, userAgent string, candidates []rendition) (rendition, bool) {
+	ranges := parseAccept(accept)
+	var best rendition
+	bestQ, bestSpecificity := 0.0, -1
+	for _, r := range candidates {
+		q, specificity := quality(ranges, r.ContentType)
+		if q <= 0 {
+			continue
+		}
+		if r.Extension == "webm" && specificity < 2 && !supportsWebM(userAgent) {
+			continue
+		}
+		if q > bestQ || (q == bestQ && specificity > bestSpecificity) {
+			best, bestQ, bestSpecificity = r, q, specificity
+		}
+	}
+	return best, bestQ > 0
+}
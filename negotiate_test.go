@@ -0,0 +1,88 @@
+package main
+
+import "testing"
+
+const (
+	chromeUA    = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+	firefoxUA   = "Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0"
+	safariUA    = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Safari/605.1.15"
+	iosChromeUA = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/120.0.6099.119 Mobile/15E148 Safari/604.1"
+	androidUA   = "Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.6099.144 Mobile Safari/537.36"
+)
+
+// The candidates negotiateAsset offers for a conversion with an original,
+// without and with the gif rendition.
+var (
+	negotiateCandidates    = append(baseRenditions[:len(baseRenditions):len(baseRenditions)], originalRendition)
+	negotiateCandidatesGIF = append(baseRenditions[:len(baseRenditions):len(baseRenditions)], optimizedGIFRendition, originalRendition)
+)
+
+func TestNegotiateRendition(t *testing.T) {
+	tests := []struct {
+		accept    string
+		userAgent string
+		gif       bool
+		want      string
+	}{
+		{"", chromeUA, false, "webm"},
+		{"", safariUA, false, "mp4"},
+		{"*/*", firefoxUA, false, "webm"},
+		{"*/*", safariUA, false, "mp4"},
+		{"*/*", iosChromeUA, false, "mp4"},
+		{"*/*", androidUA, false, "webm"},
+		{"*/*", "curl/8.4.0", false, "webm"},
+
+		{"video/*", chromeUA, false, "webm"},
+		{"video/*", safariUA, false, "mp4"},
+		{"video/webm", safariUA, false, "webm"},
+		{"video/mp4", chromeUA, false, "mp4"},
+		{"VIDEO/MP4", chromeUA, false, "mp4"},
+		{"video/webm;q=0.5, video/mp4", chromeUA, false, "mp4"},
+		{"video/*;q=0.9, video/webm", chromeUA, false, "webm"},
+		{"video/*;q=0.9, video/webm;q=0.5", chromeUA, false, "mp4"},
+		{"video/mp4;q=oops", chromeUA, false, "mp4"},
+		{"video/mp4;q=0, */*", chromeUA, false, "webm"},
+		{"video/mp4;q=0, */*", safariUA, false, "jpg"},
+
+		{"image/*", chromeUA, false, "jpg"},
+		{"image/jpeg", chromeUA, false, "jpg"},
+		{"image/gif", chromeUA, false, "original"},
+		{"image/gif", chromeUA, true, "gif"},
+		{"image/*;q=0.5, image/gif", chromeUA, true, "gif"},
+		{"*/*;q=0.1, image/gif", safariUA, false, "original"},
+		{"text/html,application/xhtml+xml,image/gif;q=0.9,*/*;q=0.8", chromeUA, false, "original"},
+	}
+	for _, test := range tests {
+		candidates := negotiateCandidates
+		if test.gif {
+			candidates = negotiateCandidatesGIF
+		}
+		r, ok := negotiateRendition(test.accept, test.userAgent, candidates)
+		got := r.Extension
+		if r == originalRendition {
+			got = "original"
+		}
+		if !ok || got != test.want {
+			t.Errorf("negotiateRendition(%q, %q, gif %v) = %v, %v, want %v", test.accept, test.userAgent, test.gif, got, ok, test.want)
+		}
+	}
+}
+
+func TestNegotiateRenditionNotAcceptable(t *testing.T) {
+	tests := []struct {
+		accept     string
+		candidates []rendition
+	}{
+		{"image/webp", negotiateCandidates},
+		{"text/html", negotiateCandidates},
+		{"application/json, text/*", negotiateCandidates},
+		{"*/*;q=0", negotiateCandidates},
+		{"image/gif", baseRenditions},
+		{"nonsense", negotiateCandidates},
+	}
+	for _, test := range tests {
+		if r, ok := negotiateRendition(test.accept, chromeUA, test.candidates); ok {
+			t.Errorf("negotiateRendition(%q) = %v, want nothing acceptable", test.accept, r.Extension)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type progressEvent struct {
+	Stage     string        `json:"stage"`
+	Extension string        `json:"extension,omitempty"`
+	Bytes     int64         `json:"bytes,omitempty"`
+	Total     int64         `json:"total,omitempty"`
+	Percent   float64       `json:"percent,omitempty"`
+	Key       string        `json:"key,omitempty"`
+	Result    *UploadResult `json:"result,omitempty"`
+	Error     string        `json:"error,omitempty"`
+}
+
+type progressFunc func(progressEvent)
+
+func (f progressFunc) report(event progressEvent) {
+	if f != nil {
+		f(event)
+	}
+}
+
+// downloadProgressReader reports how many bytes have been read, at most
+// every 100ms and once more at the end.
+type downloadProgressReader struct {
+	r          io.Reader
+	total      int64
+	read       int64
+	reportedAt time.Time
+	progress   progressFunc
+}
+
+func (d *downloadProgressReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.read += int64(n)
+	if err == io.EOF || time.Since(d.reportedAt) > 100*time.Millisecond {
+		d.reportedAt = time.Now()
+		event := progressEvent{Stage: "downloading", Bytes: d.read}
+		if d.total > 0 {
+			event.Total = d.total
+			event.Percent = float64(d.read) / float64(d.total) * 100
+		}
+		d.progress.report(event)
+	}
+	return n, err
+}
+
+func conversionProgress(progress progressFunc, extension string) func(float64) {
+	return func(percent float64) {
+		progress.report(progressEvent{Stage: "converting", Extension: extension, Percent: percent})
+	}
+}
+
+var ffmpegDuration = regexp.MustCompile(`Duration: (\d+):(\d+):(\d+(?:\.\d+)?)`)
+
+// lockedBuffer lets ffmpeg's stderr be read while it's still being written.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+// runFFmpeg runs ffmpeg with args, calling onProgress with the percentage
+// done as it goes. The percentage comes from comparing the out_time ffmpeg
+// writes with -progress against the input duration it logs to stderr. The
+// stderr output is returned for logging when ffmpeg fails.
+func runFFmpeg(onProgress func(float64), args ...string) ([]byte, error) {
+	args = append([]string{"-progress", "pipe:1", "-nostats"}, args...)
+	cmd := exec.Command(config.FFmpegPath, args...)
+	stderr := &lockedBuffer{}
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	var duration float64
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "out_time_ms":
+			if duration == 0 {
+				duration = parseFFmpegDuration(stderr.Bytes())
+			}
+			microseconds, err := strconv.ParseFloat(parts[1], 64)
+			if err != nil || duration == 0 {
+				continue
+			}
+			percent := microseconds / 1e6 / duration * 100
+			if percent > 100 {
+				percent = 100
+			}
+			onProgress(percent)
+		case "progress":
+			if parts[1] == "end" {
+				onProgress(100)
+			}
+		}
+	}
+
+	err = cmd.Wait()
+	return stderr.Bytes(), err
+}
+
+func parseFFmpegDuration(stderr []byte) float64 {
+	m := ffmpegDuration.FindSubmatch(stderr)
+	if m == nil {
+		return 0
+	}
+	hours, _ := strconv.ParseFloat(string(m[1]), 64)
+	minutes, _ := strconv.ParseFloat(string(m[2]), 64)
+	seconds, _ := strconv.ParseFloat(string(m[3]), 64)
+	return hours*3600 + minutes*60 + seconds
+}
+
+// uploadEventsHandler does the same as /upload, but streams each stage of
+// the conversion as server-sent events, ending with a "done" event carrying
+// the UploadResult or an "error" event. With ?format=ndjson the events are
+// written as lines of JSON instead.
+func uploadEventsHandler(w http.ResponseWriter, r *http.Request) {
+	log := requestLogger(r)
+	w.Header().Set("Content-Type", "application/json")
+	if !requireSignature(w, r) {
+		return
+	}
+	client, ok := authenticateClient(w, r, 1)
+	if !ok {
+		return
+	}
+
+	gifURL := r.URL.Query().Get("u")
+	if gifURL == "" {
+		client.refund(1)
+		serveError(w, r, "please specify a file to download")
+		return
+	}
+	if err := checkGIFURL(gifURL); err != nil {
+		client.refund(1)
+		serveErrorStatus(w, r, err.Error(), errorStatus(err))
+		return
+	}
+
+	ndjson := r.URL.Query().Get("format") == "ndjson"
+	if ndjson {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	flusher, _ := w.(http.Flusher)
+
+	var mu sync.Mutex
+	send := func(event progressEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		js, err := json.Marshal(event)
+		if err != nil {
+			return
+		}
+		if ndjson {
+			fmt.Fprintf(w, "%s\n", js)
+		} else {
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Stage, js)
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	uploadResult, err := convertGIF(log, gifURL, send)
+	if err != nil {
+		client.refund(1)
+		send(progressEvent{Stage: "error", Error: err.Error()})
+		return
+	}
+	send(progressEvent{Stage: "done", Result: &uploadResult})
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every conversion is recorded in the bucket as a private JSON object under
+// s3.record_prefix, so that every server, on every app, knows about the
+// conversions the others have made. The metadata store is a local copy of
+// them, filled in by syncStore.
+
+// recordSyncConcurrency is how many records syncStore fetches at once.
+const recordSyncConcurrency = 8
+
+// openSharedStore opens the metadata store at metadata_path as a copy of the
+// records in the bucket. It's only up to date once it's been synced.
+func openSharedStore() (*metadataStore, error) {
+	s, err := openMetadataStore(config.MetadataPath)
+	if err != nil {
+		return nil, err
+	}
+	s.shared = true
+	return s, nil
+}
+
+func recordKey(hash string) string {
+	return config.S3.RecordPrefix + hash
+}
+
+func putRecord(log *logger, c conversion) error {
+	body, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("x-amz-acl", "private")
+	return putBytesToS3(log, body, recordKey(c.Hash), header)
+}
+
+// getRecord returns the record of hash's conversion from the bucket, and
+// false if there isn't one.
+func getRecord(hash string) (conversion, bool, error) {
+	b, ok, err := getObject(recordKey(hash))
+	if err != nil || !ok {
+		return conversion{}, false, err
+	}
+	var c conversion
+	if err := json.Unmarshal(b, &c); err != nil {
+		return conversion{}, false, err
+	}
+	c.Hash = hash
+	return c, true, nil
+}
+
+// findConversion looks for hash's conversion in the metadata store, and then
+// in the bucket, in case another server made it since the store was last
+// synced. Ones found in the bucket are added to the store.
+func findConversion(hash string) (conversion, bool, error) {
+	if c, ok := store.conversion(hash); ok || !store.shared {
+		return c, ok, nil
+	}
+	if _, removed := store.tombstone(hash); removed {
+		return conversion{}, false, nil
+	}
+	c, ok, err := getRecord(hash)
+	if err != nil || !ok {
+		return conversion{}, false, err
+	}
+	if err := store.add([]conversion{c}); err != nil {
+		return conversion{}, false, err
+	}
+	return c, true, nil
+}
+
+// syncStore copies the records in the bucket that the metadata store doesn't
+// have into it. Hashes that have been deleted are buried instead, and
+// conversions only the store knows about, like ones recorded before there
+// were records, are written to the bucket.
+func syncStore(log *logger) error {
+	start := time.Now()
+	bucket, err := newBucket()
+	if err != nil {
+		return err
+	}
+	tombstoneObjects, err := listObjects(bucket, config.S3.TombstonePrefix)
+	if err != nil {
+		return err
+	}
+	tombstoned := map[string]bool{}
+	for _, o := range tombstoneObjects {
+		tombstoned[strings.TrimPrefix(o.Key, config.S3.TombstonePrefix)] = true
+	}
+	recordObjects, err := listObjects(bucket, config.S3.RecordPrefix)
+	if err != nil {
+		return err
+	}
+
+	recorded := map[string]bool{}
+	var missing []string
+	for _, o := range recordObjects {
+		hash := strings.TrimPrefix(o.Key, config.S3.RecordPrefix)
+		if !hashPattern.MatchString(hash) || tombstoned[hash] {
+			continue
+		}
+		recorded[hash] = true
+		if _, ok := store.conversion(hash); !ok {
+			missing = append(missing, hash)
+		}
+	}
+
+	var mu sync.Mutex
+	var fetched []conversion
+	var fetchErr error
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < recordSyncConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for hash := range queue {
+				c, ok, err := getRecord(hash)
+				mu.Lock()
+				if err != nil && fetchErr == nil {
+					fetchErr = err
+				} else if ok {
+					fetched = append(fetched, c)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, hash := range missing {
+		queue <- hash
+	}
+	close(queue)
+	wg.Wait()
+	if fetchErr != nil {
+		return fetchErr
+	}
+	if err := store.add(fetched); err != nil {
+		return err
+	}
+
+	var published, buried int
+	for _, c := range store.allConversions() {
+		if recorded[c.Hash] {
+			continue
+		}
+		if tombstoned[c.Hash] {
+			if _, _, err := findTombstone(c.Hash); err != nil {
+				return err
+			}
+			buried++
+			continue
+		}
+		if err := putRecord(log.with("hash", c.Hash), c); err != nil {
+			return err
+		}
+		published++
+	}
+
+	store.markSynced(start)
+	log.info("synced metadata store", "records", len(recorded), "fetched", len(fetched),
+		"published", published, "buried", buried, "duration", time.Since(start))
+	return nil
+}
+
+// syncStorePeriodically syncs the store now and then every
+// metadata_sync_interval, in the background, calling synced after each
+// sync that succeeds.
+func syncStorePeriodically(synced func()) {
+	log := rootLogger.with("prefix", config.S3.RecordPrefix)
+	go func() {
+		for {
+			if err := syncStore(log); err != nil {
+				log.error("syncing metadata store failed", "error", err)
+			} else {
+				synced()
+			}
+			interval := time.Duration(config.MetadataSyncInterval)
+			if interval <= 0 {
+				return
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// reencodeCacheControl is the Cache-Control renditions that replace others
+// are uploaded with by default. The configured one is usually immutable,
+// and anything that cached the old rendition would never see the new one.
+const reencodeCacheControl = "public, max-age=86400"
+
+type reencodeJob struct {
+	Hash      string
+	SourceURL string
+}
+
+// reencodeCommand converts everything in the metadata store again, or every
+// url listed in -urls, with the current ffmpeg settings and uploads the
+// results over the old ones. Each hash that's done is appended to the
+// checkpoint file, and skipped when the command is run again, so an
+// interrupted or partly failed run can be picked up where it left off.
+func reencodeCommand(args []string) error {
+	flags := flag.NewFlagSet("reencode", flag.ExitOnError)
+	urlsPath := flags.String("urls", "", "a file of source urls to reencode, one per line, or - for stdin; defaults to everything in the metadata store")
+	checkpointPath := flags.String("checkpoint", "reencode.checkpoint", "the file finished hashes are recorded in")
+	concurrency := flags.Int("concurrency", 2, "how many gifs to reencode at once")
+	dryRun := flags.Bool("dry-run", false, "list what would be reencoded without doing it")
+	cacheControl := flags.String("cache-control", reencodeCacheControl, "the Cache-Control reencoded renditions are uploaded with, instead of the configured one, since they replace objects at the same keys; empty to use the configured one")
+	c, err := loadConfig(flags, args)
+	if err != nil {
+		return err
+	}
+	if err := c.validate(!*dryRun); err != nil {
+		return err
+	}
+	if *concurrency < 1 {
+		return errors.New(fmt.Sprintf("-concurrency must be at least 1, got %d", *concurrency))
+	}
+	useConfig(c)
+	logOutput = os.Stderr
+
+	if err := os.MkdirAll(config.Scratch.Dir, 0755); err != nil {
+		return err
+	}
+	if *dryRun {
+		store, err = openMetadataStore(config.MetadataPath)
+	} else {
+		store, err = openSharedStore()
+		if err == nil {
+			err = syncStore(rootLogger)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	var jobs []reencodeJob
+	if *urlsPath != "" {
+		jobs, err = readReencodeURLs(*urlsPath)
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, conv := range store.allConversions() {
+			jobs = append(jobs, reencodeJob{Hash: conv.Hash, SourceURL: conv.SourceURL})
+		}
+	}
+
+	done, err := readCheckpoint(*checkpointPath)
+	if err != nil {
+		return err
+	}
+	var todo []reencodeJob
+	for _, job := range jobs {
+		if done[job.Hash] {
+			continue
+		}
+		// A dry run doesn't need credentials, and leaves the store alone,
+		// so it only knows about the tombstones the store already has.
+		_, removed := store.tombstone(job.Hash)
+		if !*dryRun && !removed {
+			_, removed, err = findTombstone(job.Hash)
+			if err != nil {
+				return err
+			}
+		}
+		if removed {
+			rootLogger.info("skipping removed gif", "hash", job.Hash, "url", job.SourceURL)
+			continue
+		}
+		todo = append(todo, job)
+	}
+	rootLogger.info("reencoding", "total", len(jobs), "done", len(jobs)-len(todo), "todo", len(todo))
+
+	if *dryRun {
+		for _, job := range todo {
+			fmt.Printf("%v %v\n", job.Hash, job.SourceURL)
+		}
+		return nil
+	}
+
+	checkpoint, err := os.OpenFile(*checkpointPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer checkpoint.Close()
+
+	// On SIGINT or SIGTERM, let the running conversions finish so they're
+	// checkpointed, but don't start any more.
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		rootLogger.warn("stopping after the running conversions")
+		close(stop)
+	}()
+
+	queue := make(chan reencodeJob)
+	var mu sync.Mutex
+	var finished, failed int
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				err := reencode(job, *cacheControl)
+				mu.Lock()
+				if err == nil {
+					_, err = fmt.Fprintln(checkpoint, job.Hash)
+				}
+				if err != nil {
+					failed++
+					rootLogger.error("reencoding failed", "hash", job.Hash, "url", job.SourceURL, "error", err)
+				} else {
+					finished++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for _, job := range todo {
+		select {
+		case queue <- job:
+		case <-stop:
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	rootLogger.info("reencoded", "finished", finished, "failed", failed, "remaining", len(todo)-finished)
+	if finished < len(todo) {
+		return errors.New(fmt.Sprintf("%d of %d gifs weren't reencoded, run again to retry them", len(todo)-finished, len(todo)))
+	}
+	return nil
+}
+
+// reencode removes any renditions left in the scratch directory, which
+// convertFile would otherwise reuse, and converts job.SourceURL again. The
+// archived original is used when there is one, so the origin isn't needed.
+// Otherwise local gifs converted with the convert command are read again if
+// they're still there. The renditions are uploaded with cacheControl.
+func reencode(job reencodeJob, cacheControl string) error {
+	if urlHash(job.SourceURL) != job.Hash {
+		return errors.New(fmt.Sprintf("%q doesn't hash to %v", job.SourceURL, job.Hash))
+	}
+	for _, r := range renditions {
+		os.Remove(renditionPath(job.Hash, r))
+	}
+	if c, ok := store.conversion(job.Hash); ok && c.Original != nil {
+		rootLogger.info("fetching archived original", "hash", job.Hash, "bucket", c.Original.Bucket, "key", c.Original.Key)
+		if err := getFromBucket(c.Original.Bucket, c.Original.Key, outputPath(job.SourceURL, "gif")); err != nil {
+			return err
+		}
+	} else if strings.HasPrefix(job.SourceURL, "file://") {
+		if err := stageLocalFile(job.SourceURL); err != nil {
+			return err
+		}
+	}
+	_, err := runConversion(rootLogger, job.SourceURL, nil, conversionOptions{CacheControl: cacheControl})
+	return err
+}
+
+func readReencodeURLs(path string) ([]reencodeJob, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var jobs []reencodeJob
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		jobs = append(jobs, reencodeJob{Hash: urlHash(line), SourceURL: line})
+	}
+	return jobs, scanner.Err()
+}
+
+func readCheckpoint(path string) (map[string]bool, error) {
+	done := map[string]bool{}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return done, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if hash := strings.TrimSpace(scanner.Text()); hash != "" {
+			done[hash] = true
+		}
+	}
+	return done, scanner.Err()
+}
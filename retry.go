@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/rlmcpherson/s3gof3r"
+)
+
+type retryPolicy struct {
+	Name         string   `json:"-"`
+	Attempts     int      `json:"attempts" usage:"how many times to try, including the first"`
+	InitialDelay duration `json:"initial_delay" usage:"the delay before the first retry"`
+	MaxDelay     duration `json:"max_delay" usage:"the longest delay between retries"`
+	Multiplier   float64  `json:"multiplier" usage:"how much the delay grows after each retry"`
+	Jitter       float64  `json:"jitter" usage:"up to this fraction of each delay is randomly shaved off"`
+	// StopOnDrain gives up instead of waiting for the next retry once the
+	// server starts draining, for retries that can outlast the grace period.
+	StopOnDrain bool `json:"-"`
+}
+
+// backoff returns how long to wait before the given retry (starting at 1).
+// The delay grows exponentially up to MaxDelay, and up to Jitter of it is
+// randomly shaved off so concurrent retries don't line up.
+func (p retryPolicy) backoff(retry int) time.Duration {
+	delay := float64(p.InitialDelay) * math.Pow(p.Multiplier, float64(retry-1))
+	if delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	delay -= delay * p.Jitter * rand.Float64()
+	return time.Duration(delay)
+}
+
+type retryableError struct {
+	err error
+}
+
+func (e retryableError) Error() string {
+	return e.err.Error()
+}
+
+func retryable(err error) error {
+	return retryableError{err}
+}
+
+// drainedError is returned by do when it stops retrying because the server
+// is draining, rather than because it ran out of attempts.
+type drainedError struct {
+	err error
+}
+
+func (e drainedError) Error() string {
+	return e.err.Error()
+}
+
+// do calls f until it succeeds, returns an error that isn't retryable, or
+// the policy runs out of attempts, or, with StopOnDrain, the server starts
+// draining. It returns the number of retries made.
+func (p retryPolicy) do(log *logger, f func() error) (int, error) {
+	retries := 0
+	for {
+		err := f()
+		if err == nil {
+			if retries > 0 {
+				log.info(p.Name+" succeeded after retrying", "retries", retries)
+			}
+			return retries, nil
+		}
+		r, ok := err.(retryableError)
+		if !ok {
+			return retries, err
+		}
+		if retries+1 >= p.Attempts {
+			return retries, r.err
+		}
+		if p.StopOnDrain && isDraining() {
+			return retries, drainedError{r.err}
+		}
+		retries++
+		retriesTotal.add(1, p.Name)
+		delay := p.backoff(retries)
+		log.warn(p.Name+" failed, retrying", "attempt", retries, "attempts", p.Attempts, "error", r.err, "delay", delay)
+		if !p.StopOnDrain {
+			time.Sleep(delay)
+			continue
+		}
+		select {
+		case <-time.After(delay):
+		case <-drainStarted:
+			return retries, drainedError{r.err}
+		}
+	}
+}
+
+func isTransientNetworkError(err error) bool {
+	for {
+		switch e := err.(type) {
+		case *url.Error:
+			err = e.Err
+		case *net.OpError:
+			if e.Timeout() {
+				return true
+			}
+			err = e.Err
+		case *os.SyscallError:
+			err = e.Err
+		case syscall.Errno:
+			return e == syscall.ECONNRESET || e == syscall.ECONNREFUSED || e == syscall.EPIPE || e == syscall.ETIMEDOUT
+		case net.Error:
+			return e.Timeout()
+		default:
+			return err == io.ErrUnexpectedEOF
+		}
+	}
+}
+
+func isTransientS3Error(err error) bool {
+	if e, ok := err.(*s3gof3r.RespError); ok {
+		return e.StatusCode >= 500 || e.StatusCode == http.StatusRequestTimeout || e.Code == "SlowDown" || e.Code == "RequestTimeout"
+	}
+	return isTransientNetworkError(err)
+}
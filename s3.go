@@ -0,0 +1,419 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/rlmcpherson/s3gof3r"
+)
+
+type rendition struct {
+	Name        string
+	Extension   string
+	ContentType string
+}
+
+var baseRenditions = []rendition{
+	{Name: "video", Extension: "webm", ContentType: "video/webm"},
+	{Name: "video", Extension: "mp4", ContentType: "video/mp4"},
+	{Name: "poster", Extension: "jpg", ContentType: "image/jpeg"},
+}
+
+// optimizedGIFRendition is only made with gif.enabled.
+var optimizedGIFRendition = rendition{Name: "gif", Extension: "gif", ContentType: "image/gif"}
+
+// renditions are the ones made for every gif, set by useConfig.
+var renditions = baseRenditions
+
+// originalRendition stands for the original gif, which isn't a rendition we
+// make, when it's archived or negotiated.
+var originalRendition = rendition{Name: "original", Extension: "gif", ContentType: "image/gif"}
+
+func renditionForExtension(extension string) (rendition, bool) {
+	for _, r := range renditions {
+		if r.Extension == extension {
+			return r, true
+		}
+	}
+	return rendition{}, false
+}
+
+var keyPlaceholder = regexp.MustCompile(`\{(\w+)(?:\[(\d*):(\d*)\])?\}`)
+
+// checkKeyTemplate checks that every placeholder in t is one objectKey knows
+// how to fill in, and that t gives each gif, and each of rs, its own key, so
+// that a mistake fails at boot rather than overwriting objects.
+func checkKeyTemplate(t string, rs []rendition) error {
+	hasHash := false
+	for _, m := range keyPlaceholder.FindAllStringSubmatch(t, -1) {
+		switch m[1] {
+		case "hash":
+			if m[0] == "{hash}" {
+				hasHash = true
+			}
+		case "rendition", "ext":
+		default:
+			return errors.New(fmt.Sprintf("has an unknown placeholder %q", m[0]))
+		}
+	}
+	if strings.HasPrefix(t, "/") {
+		return errors.New("must not start with a /")
+	}
+	if !hasHash {
+		return errors.New("must have the whole {hash} in it, or every gif gets the same keys")
+	}
+	hash := strings.Repeat("0", 32)
+	seen := map[string]rendition{}
+	for _, r := range rs {
+		key := fillKeyTemplate(t, hash, r)
+		if other, ok := seen[key]; ok {
+			return errors.New(fmt.Sprintf("gives the %v and %v renditions the same key %q", other.Extension, r.Extension, key))
+		}
+		seen[key] = r
+	}
+	return nil
+}
+
+func objectKey(hash string, r rendition) string {
+	return fillKeyTemplate(config.S3.KeyTemplate, hash, r)
+}
+
+func archiveKey(hash string) string {
+	return fillKeyTemplate(config.S3.Archive.KeyTemplate, hash, originalRendition)
+}
+
+// fillKeyTemplate fills in the placeholders in t. Placeholders can be sliced
+// like Go strings, so "{hash[0:2]}" is the first two characters of the hash.
+func fillKeyTemplate(t string, hash string, r rendition) string {
+	values := map[string]string{
+		"hash":      hash,
+		"rendition": r.Name,
+		"ext":       r.Extension,
+	}
+	return keyPlaceholder.ReplaceAllStringFunc(t, func(placeholder string) string {
+		m := keyPlaceholder.FindStringSubmatch(placeholder)
+		v := values[m[1]]
+		if !strings.Contains(placeholder, "[") {
+			return v
+		}
+		start, end := 0, len(v)
+		if m[2] != "" {
+			start, _ = strconv.Atoi(m[2])
+		}
+		if m[3] != "" {
+			end, _ = strconv.Atoi(m[3])
+		}
+		if end > len(v) {
+			end = len(v)
+		}
+		if start > end {
+			start = end
+		}
+		return v[start:end]
+	})
+}
+
+func objectURL(key string) string {
+	return config.S3.BucketHost + "/" + key
+}
+
+// archiveBucket is the name of the bucket originals are archived in, and the
+// url it's served from.
+func (c S3Config) archiveBucket() (string, string) {
+	if c.Archive.BucketName != "" {
+		return c.Archive.BucketName, c.Archive.BucketHost
+	}
+	return c.BucketName, c.BucketHost
+}
+
+// objectHeaders returns the headers set for r's rendition, falling back to
+// the ones set for every rendition.
+func (c S3Config) objectHeaders(r rendition) ObjectHeaders {
+	headers := c.ObjectHeaders
+	var override ObjectHeaders
+	switch r.Name {
+	case "video":
+		override = c.Video
+	case "poster":
+		override = c.Poster
+	case "gif":
+		override = c.GIF
+	case "original":
+		override = c.Archive.ObjectHeaders
+	}
+	if override.CacheControl != "" {
+		headers.CacheControl = override.CacheControl
+	}
+	if override.ACL != "" {
+		headers.ACL = override.ACL
+	}
+	if override.StorageClass != "" {
+		headers.StorageClass = override.StorageClass
+	}
+	return headers
+}
+
+type objectMetadata struct {
+	SourceURL string
+	Width     int
+	Height    int
+	SHA256    string
+}
+
+func objectHeader(r rendition, meta objectMetadata) http.Header {
+	header := http.Header{}
+	headers := config.S3.objectHeaders(r)
+	header.Set("Content-Type", r.ContentType)
+	if headers.CacheControl != "" {
+		header.Set("Cache-Control", headers.CacheControl)
+	}
+	if headers.ACL != "" {
+		header.Set("x-amz-acl", headers.ACL)
+	}
+	if headers.StorageClass != "" {
+		header.Set("x-amz-storage-class", headers.StorageClass)
+	}
+	header.Set("x-amz-meta-rendition", r.Name)
+	header.Set("x-amz-meta-source-url", meta.SourceURL)
+	header.Set("x-amz-meta-width", strconv.Itoa(meta.Width))
+	header.Set("x-amz-meta-height", strconv.Itoa(meta.Height))
+	if meta.SHA256 != "" {
+		header.Set("x-amz-meta-sha256", meta.SHA256)
+	}
+	return header
+}
+
+func putToS3(log *logger, path string, key string, header http.Header) error {
+	return putToBucket(log, config.S3.BucketName, path, key, header)
+}
+
+// putBytesToS3 uploads body to key, by way of a file in the scratch
+// directory.
+func putBytesToS3(log *logger, body []byte, key string, header http.Header) error {
+	f, err := ioutil.TempFile(config.Scratch.Dir, "put")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return putToS3(log, f.Name(), key, header)
+}
+
+func putToBucket(log *logger, bucketName string, path string, key string, header http.Header) error {
+	_, err := config.S3.PutRetry.do(log.with("key", key), func() error {
+		err := putFileToS3(bucketName, path, key, header)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(integrityError); ok || isTransientS3Error(err) {
+			return retryable(err)
+		}
+		return err
+	})
+	return err
+}
+
+func putFileToS3(bucketName string, path string, key string, header http.Header) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	bucket, err := newNamedBucket(bucketName)
+	if err != nil {
+		return err
+	}
+	writer, err := bucket.PutWriter(key, header, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(writer, file)
+	if err != nil {
+		writer.Close()
+		return err
+	}
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+
+	if config.S3.Verify {
+		return verifyObject(bucket, key, path)
+	}
+	return nil
+}
+
+// deleteFromS3 removes the object at key, along with any .md5 file stored
+// for it when it was uploaded with S3_VERIFY.
+func deleteFromS3(key string) error {
+	return deleteFromBucket(config.S3.BucketName, key)
+}
+
+func deleteFromBucket(bucketName string, key string) error {
+	bucket, err := newNamedBucket(bucketName)
+	if err != nil {
+		return err
+	}
+	return bucket.Delete(key)
+}
+
+// getFromBucket downloads the object at key to path.
+func getFromBucket(bucketName string, key string, path string) error {
+	bucket, err := newNamedBucket(bucketName)
+	if err != nil {
+		return err
+	}
+	reader, _, err := bucket.GetReader(key, nil)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, reader); err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+	return file.Close()
+}
+
+// getObject returns the body of the small object at key in the bucket, and
+// false if there's no such object.
+func getObject(key string) ([]byte, bool, error) {
+	bucket, err := newBucket()
+	if err != nil {
+		return nil, false, err
+	}
+	req, err := http.NewRequest("GET", bucketObjectURL(bucket, key).String(), nil)
+	if err != nil {
+		return nil, false, err
+	}
+	bucket.Sign(req)
+	resp, err := bucket.Config.Client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, false, nil
+	default:
+		return nil, false, errors.New(fmt.Sprintf("getting %v returned %v", key, resp.Status))
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	return b, true, nil
+}
+
+func newBucket() (*s3gof3r.Bucket, error) {
+	return newNamedBucket(config.S3.BucketName)
+}
+
+func newNamedBucket(name string) (*s3gof3r.Bucket, error) {
+	keys, err := s3Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	domain := config.S3.Endpoint
+	if domain == "" && config.S3.Region != "" && config.S3.Region != "us-east-1" {
+		domain = "s3-" + config.S3.Region + ".amazonaws.com"
+	}
+
+	bucketConfig := *s3gof3r.DefaultConfig
+	bucketConfig.Scheme = config.S3.Scheme
+	bucketConfig.PathStyle = config.S3.PathStyle
+
+	bucket := s3gof3r.New(domain, keys).Bucket(name)
+	bucket.Config = &bucketConfig
+	return bucket, nil
+}
+
+func s3Keys() (s3gof3r.Keys, error) {
+	switch config.S3.Credentials {
+	case "env":
+		if config.AWS.AccessKeyID == "" || config.AWS.SecretAccessKey == "" {
+			return s3gof3r.Keys{}, errors.New("aws.access_key_id and aws.secret_access_key are not set")
+		}
+		return s3gof3r.Keys{
+			AccessKey:     config.AWS.AccessKeyID,
+			SecretKey:     config.AWS.SecretAccessKey,
+			SecurityToken: config.AWS.SecurityToken,
+		}, nil
+	case "instance":
+		return s3gof3r.InstanceKeys()
+	case "file":
+		return fileKeys(config.S3.CredentialsFile, config.S3.CredentialsProfile)
+	}
+	return s3gof3r.Keys{}, errors.New(fmt.Sprintf("s3.credentials must be env, instance or file, got %q", config.S3.Credentials))
+}
+
+// fileKeys reads keys from a profile in an AWS shared credentials file, like
+// the one the aws cli writes to ~/.aws/credentials.
+func fileKeys(path string, profile string) (s3gof3r.Keys, error) {
+	if path == "" {
+		path = filepath.Join(os.Getenv("HOME"), ".aws", "credentials")
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return s3gof3r.Keys{}, err
+	}
+
+	var keys s3gof3r.Keys
+	found := false
+	section := ""
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if section != profile {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		found = true
+		value := strings.TrimSpace(parts[1])
+		switch strings.TrimSpace(parts[0]) {
+		case "aws_access_key_id":
+			keys.AccessKey = value
+		case "aws_secret_access_key":
+			keys.SecretKey = value
+		case "aws_session_token":
+			keys.SecurityToken = value
+		}
+	}
+	if !found || keys.AccessKey == "" || keys.SecretKey == "" {
+		return s3gof3r.Keys{}, errors.New(fmt.Sprintf("no aws_access_key_id and aws_secret_access_key for profile %q in %v", profile, path))
+	}
+	return keys, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+const testHash = "ffbbcc7fb8acaca2e3839414bc3a61bd"
+
+var allTestRenditions = append(baseRenditions[:len(baseRenditions):len(baseRenditions)], optimizedGIFRendition)
+
+func TestFillKeyTemplate(t *testing.T) {
+	webm := baseRenditions[0]
+	tests := []struct {
+		template string
+		r        rendition
+		want     string
+	}{
+		{"{hash}.{ext}", webm, testHash + ".webm"},
+		{"gifs/{hash[0:2]}/{hash}/{rendition}.{ext}", webm, "gifs/ff/" + testHash + "/video.webm"},
+		{"{hash[:4]}/{hash[28:]}/{hash}.{ext}", webm, "ffbb/61bd/" + testHash + ".webm"},
+		{"{hash[30:40]}-{hash}.{ext}", webm, "bd-" + testHash + ".webm"},
+		{"{hash[40:50]}-{hash}.{ext}", webm, "-" + testHash + ".webm"},
+		{"{hash[5:2]}-{hash}.{ext}", webm, "-" + testHash + ".webm"},
+		{"{hash}.{ext[1:]}", optimizedGIFRendition, testHash + ".if"},
+		{"{hash}.optimized.{ext}", optimizedGIFRendition, testHash + ".optimized.gif"},
+		{"originals/{hash}.{ext}", originalRendition, "originals/" + testHash + ".gif"},
+		{"no placeholders", webm, "no placeholders"},
+	}
+	for _, test := range tests {
+		if got := fillKeyTemplate(test.template, testHash, test.r); got != test.want {
+			t.Errorf("fillKeyTemplate(%q, %v) = %q, want %q", test.template, test.r.Extension, got, test.want)
+		}
+	}
+}
+
+func TestCheckKeyTemplate(t *testing.T) {
+	for _, template := range []string{
+		"{hash}.{ext}",
+		"gifs/{hash[0:2]}/{hash}/{rendition}.{ext}",
+		"{hash}/{ext}",
+		"{ext}/{hash}",
+	} {
+		if err := checkKeyTemplate(template, allTestRenditions); err != nil {
+			t.Errorf("checkKeyTemplate(%q) = %v, want nil", template, err)
+		}
+	}
+	if err := checkKeyTemplate("originals/{hash}", []rendition{originalRendition}); err != nil {
+		t.Errorf("checkKeyTemplate() of an archive template without {ext} = %v, want nil", err)
+	}
+}
+
+func TestCheckKeyTemplateErrors(t *testing.T) {
+	for _, template := range []string{
+		"",
+		"gifs.{ext}",
+		"{hash[0:8]}.{ext}",
+		"{hash[0:2]}/{hash[2:]}.{ext}",
+		"{hash}",
+		"{hash}.{rendition}",
+		"{hash}.{format}",
+		"/{hash}.{ext}",
+	} {
+		if err := checkKeyTemplate(template, allTestRenditions); err == nil {
+			t.Errorf("checkKeyTemplate(%q) = nil, want an error", template)
+		}
+	}
+}
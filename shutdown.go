@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var errShuttingDown = errors.New("the server is shutting down, please try again")
+
+var draining int32
+
+// drainStarted is closed when the server starts draining, to wake up
+// anything that's waiting, like callbacks backing off between retries.
+var drainStarted = make(chan struct{})
+
+// backgroundJobs tracks work that carries on after its request has been
+// answered, like conversions with a callback, so shutdown can wait for it.
+var backgroundJobs sync.WaitGroup
+
+func isDraining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+func startDraining() {
+	if atomic.CompareAndSwapInt32(&draining, 0, 1) {
+		close(drainStarted)
+	}
+}
+
+// goBackground runs f in a goroutine that shutdown will wait for. It must
+// be called while handling a request, so it's counted before the server
+// finishes draining requests and shutdown starts waiting.
+func goBackground(f func()) {
+	backgroundJobs.Add(1)
+	go func() {
+		defer backgroundJobs.Done()
+		f()
+	}()
+}
+
+// serveUntilShutdown serves on addr until SIGTERM or SIGINT. It then stops
+// taking new conversions, waits up to the grace period for requests and
+// background jobs to finish, and cleans up the scratch directory if they
+// did.
+func serveUntilShutdown(addr string) error {
+	server := &http.Server{Addr: addr}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-signals:
+		rootLogger.info("shutting down", "signal", sig, "grace_period", config.Shutdown.GracePeriod)
+	}
+
+	startDraining()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.Shutdown.GracePeriod))
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		rootLogger.warn("requests still running after the grace period", "error", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		backgroundJobs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		cleanScratchDir()
+	case <-ctx.Done():
+		// The running conversions are still using their scratch files.
+		rootLogger.warn("background jobs still running after the grace period, leaving the scratch directory",
+			"jobs_in_flight", atomic.LoadInt64(&jobsInFlight))
+	}
+
+	rootLogger.info("shut down")
+	return nil
+}
+
+// scratchFile matches the files the server writes to the scratch directory:
+// downloads and renditions named after their hash, and the temporary files
+// putBytesToS3 uploads from.
+var scratchFile = regexp.MustCompile(`^(?:[0-9a-f]{32}\.[a-z.]+|put\d+)$`)
+
+// cleanScratchDir removes the server's own files from the scratch
+// directory, leaving anything else that's there alone.
+func cleanScratchDir() {
+	scratchDir := config.Scratch.Dir
+	files, err := ioutil.ReadDir(scratchDir)
+	if err != nil {
+		rootLogger.error("cleaning scratch directory failed", "error", err)
+		return
+	}
+	for _, f := range files {
+		if !f.Mode().IsRegular() || !scratchFile.MatchString(f.Name()) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(scratchDir, f.Name())); err != nil {
+			rootLogger.error("cleaning scratch directory failed", "error", err)
+		}
+	}
+}
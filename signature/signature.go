@@ -0,0 +1,142 @@
+// Package signature signs and verifies ancientcitadelgifs request urls.
+//
+// A signed url carries an "expires" parameter holding a unix timestamp, and a
+// "signature" parameter holding the hex HMAC-SHA256 of the url path and all
+// of its other query parameters, keyed with a secret shared with the service:
+//
+//	u, err := signature.SignURL(secret, "https://gifs.example.com/upload?u="+url.QueryEscape(gif), time.Now().Add(time.Hour))
+//
+// The url of a POST is signed with SignBodyURL, which adds a "body_sha256"
+// parameter with the hex SHA-256 of the body, so the body is signed too:
+//
+//	u, err := signature.SignBodyURL(secret, "https://gifs.example.com/batch", body, time.Now().Add(time.Hour))
+//
+// Webhook callbacks from the service are signed with SignPayload, and can be
+// checked with VerifyPayload.
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrMissing = errors.New("signature: the url isn't signed")
+	ErrExpired = errors.New("signature: the url has expired")
+	ErrInvalid = errors.New("signature: the signature doesn't match")
+)
+
+// Sign returns a copy of query with "expires" and "signature" set for a
+// request to path.
+func Sign(secret []byte, path string, query url.Values, expires time.Time) url.Values {
+	signed := url.Values{}
+	for k, v := range query {
+		if k != "signature" {
+			signed[k] = append([]string(nil), v...)
+		}
+	}
+	signed.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	signed.Set("signature", sign(secret, path, signed))
+	return signed
+}
+
+// SignURL signs rawurl, keeping its existing query parameters.
+func SignURL(secret []byte, rawurl string, expires time.Time) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	u.RawQuery = Sign(secret, u.Path, u.Query(), expires).Encode()
+	return u.String(), nil
+}
+
+// BodyParameter is the query parameter SignBodyURL puts the hash of the
+// body in.
+const BodyParameter = "body_sha256"
+
+// SignBodyURL signs rawurl for a request with body, keeping its existing
+// query parameters.
+func SignBodyURL(secret []byte, rawurl string, body []byte, expires time.Time) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set(BodyParameter, bodyHash(body))
+	u.RawQuery = Sign(secret, u.Path, query, expires).Encode()
+	return u.String(), nil
+}
+
+// VerifyBody checks that body is the one a query, which has already been
+// checked with Verify, was signed for.
+func VerifyBody(query url.Values, body []byte) error {
+	given := query.Get(BodyParameter)
+	if given == "" {
+		return ErrMissing
+	}
+	if !hmac.Equal([]byte(given), []byte(bodyHash(body))) {
+		return ErrInvalid
+	}
+	return nil
+}
+
+func bodyHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// Verify checks the signature of a request to path, and that it hasn't
+// expired by now.
+func Verify(secret []byte, path string, query url.Values, now time.Time) error {
+	given := query.Get("signature")
+	if given == "" || query.Get("expires") == "" {
+		return ErrMissing
+	}
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return ErrInvalid
+	}
+	if !hmac.Equal([]byte(given), []byte(sign(secret, path, query))) {
+		return ErrInvalid
+	}
+	if now.Unix() > expires {
+		return ErrExpired
+	}
+	return nil
+}
+
+func sign(secret []byte, path string, query url.Values) string {
+	unsigned := url.Values{}
+	for k, v := range query {
+		if k != "signature" {
+			unsigned[k] = v
+		}
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(path + "\n" + unsigned.Encode()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignPayload returns the value of the X-Signature header sent with a body:
+// "sha256=" followed by the hex HMAC-SHA256 of body.
+func SignPayload(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyPayload checks an X-Signature header against body.
+func VerifyPayload(secret []byte, body []byte, header string) error {
+	if header == "" {
+		return ErrMissing
+	}
+	if !hmac.Equal([]byte(header), []byte(SignPayload(secret, body))) {
+		return ErrInvalid
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package signature
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+var secret = []byte("secret")
+
+func signedQuery(expires time.Time) url.Values {
+	query := url.Values{"u": {"https://example.com/a.gif"}, "callback": {"https://example.com/done"}}
+	return Sign(secret, "/upload", query, expires)
+}
+
+func TestRoundTrip(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	query := signedQuery(now.Add(time.Hour))
+	if err := Verify(secret, "/upload", query, now); err != nil {
+		t.Fatalf("Verify() = %v, want nil", err)
+	}
+	if got := query.Get("u"); got != "https://example.com/a.gif" {
+		t.Errorf("u = %q, the other parameters should be kept", got)
+	}
+}
+
+func TestRoundTripURL(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	signed, err := SignURL(secret, "https://gifs.example.com/upload?u="+url.QueryEscape("https://example.com/a b.gif"), now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(secret, u.Path, u.Query(), now); err != nil {
+		t.Fatalf("Verify(%q) = %v, want nil", signed, err)
+	}
+}
+
+func TestResigning(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	query := Sign(secret, "/upload", signedQuery(now), now.Add(time.Hour))
+	if err := Verify(secret, "/upload", query, now); err != nil {
+		t.Fatalf("Verify() = %v, want nil for a url signed twice", err)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	expires := time.Unix(1500000000, 0)
+	query := signedQuery(expires)
+	if err := Verify(secret, "/upload", query, expires); err != nil {
+		t.Errorf("Verify() at the expiry = %v, want nil", err)
+	}
+	if err := Verify(secret, "/upload", query, expires.Add(time.Second)); err != ErrExpired {
+		t.Errorf("Verify() after the expiry = %v, want %v", err, ErrExpired)
+	}
+}
+
+func TestTampering(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	tests := []struct {
+		name   string
+		path   string
+		secret []byte
+		change func(url.Values)
+	}{
+		{"changed parameter", "/upload", secret, func(q url.Values) { q.Set("u", "https://example.com/b.gif") }},
+		{"added parameter", "/upload", secret, func(q url.Values) { q.Set("stream", "true") }},
+		{"removed parameter", "/upload", secret, func(q url.Values) { q.Del("callback") }},
+		{"extended expiry", "/upload", secret, func(q url.Values) { q.Set("expires", "1600000000") }},
+		{"invalid expiry", "/upload", secret, func(q url.Values) { q.Set("expires", "soon") }},
+		{"changed signature", "/upload", secret, func(q url.Values) { q.Set("signature", q.Get("signature")[1:]+"0") }},
+		{"other path", "/batch", secret, func(url.Values) {}},
+		{"other secret", "/upload", []byte("another secret"), func(url.Values) {}},
+	}
+	for _, test := range tests {
+		query := signedQuery(now.Add(time.Hour))
+		test.change(query)
+		if err := Verify(test.secret, test.path, query, now); err != ErrInvalid {
+			t.Errorf("%v: Verify() = %v, want %v", test.name, err, ErrInvalid)
+		}
+	}
+}
+
+func TestMissingSignature(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	for _, param := range []string{"signature", "expires"} {
+		query := signedQuery(now.Add(time.Hour))
+		query.Del(param)
+		if err := Verify(secret, "/upload", query, now); err != ErrMissing {
+			t.Errorf("Verify() without %v = %v, want %v", param, err, ErrMissing)
+		}
+	}
+	if err := Verify(secret, "/upload", url.Values{}, now); err != ErrMissing {
+		t.Errorf("Verify() of an unsigned url = %v, want %v", err, ErrMissing)
+	}
+}
+
+func TestBody(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	body := []byte(`["https://example.com/a.gif"]`)
+	signed, err := SignBodyURL(secret, "https://gifs.example.com/batch?stream=true", body, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(secret, u.Path, u.Query(), now); err != nil {
+		t.Fatalf("Verify(%q) = %v, want nil", signed, err)
+	}
+	if err := VerifyBody(u.Query(), body); err != nil {
+		t.Errorf("VerifyBody() = %v, want nil", err)
+	}
+	if err := VerifyBody(u.Query(), []byte(`["https://example.com/b.gif"]`)); err != ErrInvalid {
+		t.Errorf("VerifyBody() of another body = %v, want %v", err, ErrInvalid)
+	}
+
+	query := u.Query()
+	query.Set(BodyParameter, bodyHash([]byte(`["https://example.com/b.gif"]`)))
+	if err := Verify(secret, u.Path, query, now); err != ErrInvalid {
+		t.Errorf("Verify() with the hash of another body = %v, want %v", err, ErrInvalid)
+	}
+
+	unsigned, err := SignURL(secret, "https://gifs.example.com/batch", now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ = url.Parse(unsigned)
+	if err := VerifyBody(u.Query(), body); err != ErrMissing {
+		t.Errorf("VerifyBody() of a url signed without a body = %v, want %v", err, ErrMissing)
+	}
+}
+
+func TestPayload(t *testing.T) {
+	body := []byte(`{"url":"https://example.com/a.gif"}`)
+	header := SignPayload(secret, body)
+	if err := VerifyPayload(secret, body, header); err != nil {
+		t.Errorf("VerifyPayload() = %v, want nil", err)
+	}
+	if err := VerifyPayload(secret, []byte(`{"url":"https://example.com/b.gif"}`), header); err != ErrInvalid {
+		t.Errorf("VerifyPayload() of another body = %v, want %v", err, ErrInvalid)
+	}
+	if err := VerifyPayload(secret, body, ""); err != ErrMissing {
+		t.Errorf("VerifyPayload() without a header = %v, want %v", err, ErrMissing)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// sourceRule matches urls by scheme, host, port and path prefix. Empty fields
+// match anything, and a host starting with "*." matches any subdomain.
+type sourceRule struct {
+	Scheme     string
+	Host       string
+	Port       string
+	PathPrefix string
+}
+
+var sourceAllowRules []sourceRule
+var sourceDenyRules []sourceRule
+
+// parseSourceRules parses rules like "https://*.giphy.com",
+// "i.imgur.com:443/a/" or "*://reddit.com".
+func parseSourceRules(values []string) ([]sourceRule, error) {
+	var rules []sourceRule
+	for _, s := range values {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		var rule sourceRule
+		if i := strings.Index(s, "://"); i != -1 {
+			rule.Scheme = strings.ToLower(s[:i])
+			s = s[i+3:]
+		}
+		if rule.Scheme == "*" {
+			rule.Scheme = ""
+		}
+		if i := strings.Index(s, "/"); i != -1 {
+			rule.PathPrefix = s[i:]
+			s = s[:i]
+		}
+		if host, port, err := net.SplitHostPort(s); err == nil {
+			rule.Host, rule.Port = host, port
+		} else {
+			rule.Host = s
+		}
+		rule.Host = strings.ToLower(rule.Host)
+		if rule.Host == "*" {
+			rule.Host = ""
+		}
+		if rule.Scheme != "" && rule.Scheme != "http" && rule.Scheme != "https" {
+			return nil, errors.New(fmt.Sprintf("%q has a scheme that can't be downloaded from", s))
+		}
+		if strings.Contains(strings.TrimPrefix(rule.Host, "*."), "*") {
+			return nil, errors.New(fmt.Sprintf("%q can only have a wildcard at the start of the host", s))
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (rule sourceRule) matches(u *url.URL) bool {
+	if rule.Scheme != "" && rule.Scheme != u.Scheme {
+		return false
+	}
+	host := strings.ToLower(u.Host)
+	port := defaultPort(u.Scheme)
+	if h, p, err := net.SplitHostPort(u.Host); err == nil {
+		host, port = strings.ToLower(h), p
+	}
+	if strings.HasPrefix(rule.Host, "*.") {
+		if !strings.HasSuffix(host, rule.Host[1:]) {
+			return false
+		}
+	} else if rule.Host != "" && rule.Host != host {
+		return false
+	}
+	if rule.Port != "" && rule.Port != port {
+		return false
+	}
+	if rule.PathPrefix != "" && !strings.HasPrefix(path.Clean("/"+u.Path), rule.PathPrefix) {
+		return false
+	}
+	return true
+}
+
+func defaultPort(scheme string) string {
+	if scheme == "https" {
+		return "443"
+	}
+	return "80"
+}
+
+type sourceRejectedError struct {
+	url    string
+	reason string
+}
+
+func (e sourceRejectedError) Error() string {
+	return fmt.Sprintf("%q can't be downloaded: %v", e.url, e.reason)
+}
+
+// checkSource returns a sourceRejectedError if gifURL isn't http or https,
+// matches a deny rule, or doesn't match any allow rule when there are some.
+func checkSource(gifURL string) error {
+	u, err := url.Parse(gifURL)
+	if err != nil {
+		return sourceRejectedError{gifURL, err.Error()}
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return sourceRejectedError{gifURL, "only http and https urls are allowed"}
+	}
+	if u.Host == "" || u.User != nil {
+		return sourceRejectedError{gifURL, "the url needs a host and no credentials"}
+	}
+	for _, rule := range sourceDenyRules {
+		if rule.matches(u) {
+			return sourceRejectedError{gifURL, "the source is blocked"}
+		}
+	}
+	if len(sourceAllowRules) == 0 {
+		return nil
+	}
+	for _, rule := range sourceAllowRules {
+		if rule.matches(u) {
+			return nil
+		}
+	}
+	return sourceRejectedError{gifURL, "the source isn't on the allowlist"}
+}
+
+func isSourceRejected(err error) bool {
+	for {
+		switch e := err.(type) {
+		case sourceRejectedError:
+			return true
+		case *url.Error:
+			err = e.Err
+		case *net.OpError:
+			err = e.Err
+		default:
+			return false
+		}
+	}
+}
+
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	return checkSource(req.URL.String())
+}
+
+// dialPublic refuses to connect to loopback, private and link-local
+// addresses unless SOURCE_ALLOW_PRIVATE is set, so that a public hostname
+// can't be pointed at something internal.
+func dialPublic(network string, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if config.Source.AllowPrivate {
+		return dialer.Dial(network, addr)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if isPrivateIP(ip) {
+			return nil, sourceRejectedError{host, "it resolves to a private address"}
+		}
+	}
+	return dialer.Dial(network, net.JoinHostPort(ips[0].String(), port))
+}
+
+var privateNetworks = parseCIDRs(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.168.0.0/16", "::1/128", "fc00::/7", "fe80::/10",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func isPrivateIP(ip net.IP) bool {
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseSourceRules(t *testing.T) {
+	tests := []struct {
+		value string
+		rule  sourceRule
+	}{
+		{"giphy.com", sourceRule{Host: "giphy.com"}},
+		{"https://*.giphy.com", sourceRule{Scheme: "https", Host: "*.giphy.com"}},
+		{"*://Reddit.com", sourceRule{Host: "reddit.com"}},
+		{"i.imgur.com:443/a/", sourceRule{Host: "i.imgur.com", Port: "443", PathPrefix: "/a/"}},
+		{"HTTP://*:8080", sourceRule{Scheme: "http", Port: "8080"}},
+		{"*/gifs/", sourceRule{PathPrefix: "/gifs/"}},
+	}
+	for _, test := range tests {
+		rules, err := parseSourceRules([]string{test.value})
+		if err != nil {
+			t.Errorf("parseSourceRules(%q) = %v", test.value, err)
+			continue
+		}
+		if len(rules) != 1 || !reflect.DeepEqual(rules[0], test.rule) {
+			t.Errorf("parseSourceRules(%q) = %+v, want %+v", test.value, rules, test.rule)
+		}
+	}
+}
+
+func TestParseSourceRulesSkipsBlanks(t *testing.T) {
+	rules, err := parseSourceRules([]string{"", " giphy.com ", "  "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []sourceRule{{Host: "giphy.com"}}; !reflect.DeepEqual(rules, want) {
+		t.Errorf("parseSourceRules() = %+v, want %+v", rules, want)
+	}
+}
+
+func TestParseSourceRulesErrors(t *testing.T) {
+	for _, value := range []string{
+		"ftp://giphy.com",
+		"file:///etc",
+		"media.*.giphy.com",
+		"*giphy.com",
+		"*.*.giphy.com",
+	} {
+		if rules, err := parseSourceRules([]string{value}); err == nil {
+			t.Errorf("parseSourceRules(%q) = %+v, want an error", value, rules)
+		}
+	}
+}
+
+func TestSourceRuleMatches(t *testing.T) {
+	tests := []struct {
+		rule    string
+		url     string
+		matches bool
+	}{
+		{"giphy.com", "https://giphy.com/a.gif", true},
+		{"giphy.com", "http://GIPHY.com/a.gif", true},
+		{"giphy.com", "https://media.giphy.com/a.gif", false},
+		{"giphy.com", "https://giphy.com.evil.com/a.gif", false},
+
+		{"*.giphy.com", "https://media.giphy.com/a.gif", true},
+		{"*.giphy.com", "https://a.b.giphy.com/a.gif", true},
+		{"*.giphy.com", "https://giphy.com/a.gif", false},
+		{"*.giphy.com", "https://evilgiphy.com/a.gif", false},
+		{"*.giphy.com", "https://media.giphy.com.evil.com/a.gif", false},
+		{"*", "https://anything.example.com/a.gif", true},
+
+		{"https://giphy.com", "https://giphy.com/a.gif", true},
+		{"https://giphy.com", "http://giphy.com/a.gif", false},
+		{"*://giphy.com", "http://giphy.com/a.gif", true},
+
+		{"i.imgur.com:443", "https://i.imgur.com/a.gif", true},
+		{"i.imgur.com:443", "https://i.imgur.com:443/a.gif", true},
+		{"i.imgur.com:443", "http://i.imgur.com/a.gif", false},
+		{"i.imgur.com:443", "https://i.imgur.com:8443/a.gif", false},
+		{"i.imgur.com:80", "http://i.imgur.com/a.gif", true},
+		{"i.imgur.com", "https://i.imgur.com:8443/a.gif", true},
+
+		{"i.imgur.com/a/", "https://i.imgur.com/a/b.gif", true},
+		{"i.imgur.com/a/", "https://i.imgur.com/a/b/c.gif", true},
+		{"i.imgur.com/a/", "https://i.imgur.com/ab.gif", false},
+		{"i.imgur.com/a/", "https://i.imgur.com/b/a/c.gif", false},
+		{"i.imgur.com/a/", "https://i.imgur.com/a/../b/c.gif", false},
+		{"i.imgur.com/a/", "https://i.imgur.com/a/%2e%2e/b/c.gif", false},
+		{"i.imgur.com/a/", "https://i.imgur.com/a/./b/../c.gif", true},
+		{"i.imgur.com/a/", "https://i.imgur.com//a/b.gif", true},
+		{"i.imgur.com/a/", "https://i.imgur.com/../a/b.gif", true},
+	}
+	for _, test := range tests {
+		rules, err := parseSourceRules([]string{test.rule})
+		if err != nil {
+			t.Fatalf("parseSourceRules(%q) = %v", test.rule, err)
+		}
+		u, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := rules[0].matches(u); got != test.matches {
+			t.Errorf("%q matches %q = %v, want %v", test.rule, test.url, got, test.matches)
+		}
+	}
+}
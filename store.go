@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+type conversion struct {
+	Hash      string            `json:"hash"`
+	SourceURL string            `json:"source_url"`
+	Keys      map[string]string `json:"keys"`
+	Result    UploadResult      `json:"result"`
+	Original  *archivedOriginal `json:"original,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt *time.Time        `json:"updated_at,omitempty"`
+}
+
+// archivedOriginal is where the original gif was archived. The bucket is
+// kept in case the archive moves to another one.
+type archivedOriginal struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+}
+
+type tombstone struct {
+	Hash      string    `json:"hash"`
+	SourceURL string    `json:"source_url,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// metadataStore keeps track of every conversion and every deleted GIF in a
+// single JSON file, which is rewritten on each change. A shared store is a
+// local copy of the records kept in the bucket, see records.go.
+type metadataStore struct {
+	path        string
+	shared      bool
+	syncedAt    time.Time
+	mu          sync.Mutex
+	Conversions map[string]*conversion `json:"conversions"`
+	Tombstones  map[string]*tombstone  `json:"tombstones"`
+}
+
+var store *metadataStore
+
+func openMetadataStore(path string) (*metadataStore, error) {
+	s := &metadataStore{
+		path:        path,
+		Conversions: map[string]*conversion{},
+		Tombstones:  map[string]*tombstone{},
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, err
+	}
+	if s.Conversions == nil {
+		s.Conversions = map[string]*conversion{}
+	}
+	if s.Tombstones == nil {
+		s.Tombstones = map[string]*tombstone{}
+	}
+	return s, nil
+}
+
+// save must be called with s.mu held. The file is written next to the old
+// one and renamed over it, so a crash never leaves half a store behind.
+func (s *metadataStore) save() error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// recordConversion records c, keeping the time the hash was first converted
+// if it's being converted again. When the store is shared, c is written to
+// the bucket first, so every server knows about it.
+func (s *metadataStore) recordConversion(c conversion) error {
+	old, ok := s.conversion(c.Hash)
+	if !ok && s.shared {
+		var err error
+		if old, ok, err = getRecord(c.Hash); err != nil {
+			return err
+		}
+	}
+	if ok {
+		updatedAt := c.CreatedAt
+		c.CreatedAt, c.UpdatedAt = old.CreatedAt, &updatedAt
+	}
+	if s.shared {
+		if err := putRecord(rootLogger.with("hash", c.Hash), c); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Conversions[c.Hash] = &c
+	return s.save()
+}
+
+// add records conversions that were recorded somewhere else, unless they've
+// been deleted since.
+func (s *metadataStore) add(conversions []conversion) error {
+	if len(conversions) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range conversions {
+		c := conversions[i]
+		if _, removed := s.Tombstones[c.Hash]; !removed {
+			s.Conversions[c.Hash] = &c
+		}
+	}
+	return s.save()
+}
+
+func (s *metadataStore) markSynced(at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.syncedAt = at
+}
+
+// lastSynced is when the store was last synced from the bucket, or the zero
+// time if it hasn't been since it was opened.
+func (s *metadataStore) lastSynced() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.syncedAt
+}
+
+func (s *metadataStore) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.Conversions)
+}
+
+// allConversions returns every conversion, oldest first.
+func (s *metadataStore) allConversions() []conversion {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all := make([]conversion, 0, len(s.Conversions))
+	for _, c := range s.Conversions {
+		all = append(all, *c)
+	}
+	sort.Sort(byCreatedAt(all))
+	return all
+}
+
+// recentConversions returns up to limit conversions, newest first, after
+// skipping offset of them, and how many there are altogether.
+func (s *metadataStore) recentConversions(offset int, limit int) ([]conversion, int) {
+	all := s.allConversions()
+	var recent []conversion
+	for i := len(all) - 1 - offset; i >= 0 && len(recent) < limit; i-- {
+		recent = append(recent, all[i])
+	}
+	return recent, len(all)
+}
+
+type byCreatedAt []conversion
+
+func (a byCreatedAt) Len() int           { return len(a) }
+func (a byCreatedAt) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byCreatedAt) Less(i, j int) bool { return a[i].CreatedAt.Before(a[j].CreatedAt) }
+
+func (s *metadataStore) conversion(hash string) (conversion, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.Conversions[hash]
+	if !ok {
+		return conversion{}, false
+	}
+	return *c, true
+}
+
+func (s *metadataStore) tombstone(hash string) (tombstone, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.Tombstones[hash]
+	if !ok {
+		return tombstone{}, false
+	}
+	return *t, true
+}
+
+// bury forgets the conversion for t.Hash and records t in its place.
+func (s *metadataStore) bury(t tombstone) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.Conversions, t.Hash)
+	s.Tombstones[t.Hash] = &t
+	return s.save()
+}
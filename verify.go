@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/rlmcpherson/s3gof3r"
+)
+
+type integrityError struct {
+	key    string
+	reason string
+}
+
+func (e integrityError) Error() string {
+	return fmt.Sprintf("verifying %q failed: %v", e.key, e.reason)
+}
+
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// multipartETag works out the ETag S3 gives an object uploaded in parts of
+// partSize: the md5 of the concatenated part md5s, followed by the part count.
+func multipartETag(path string, partSize int64) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	md5OfParts := md5.New()
+	parts := 0
+	for {
+		h := md5.New()
+		n, err := io.CopyN(h, file, partSize)
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		if n > 0 || parts == 0 {
+			md5OfParts.Write(h.Sum(nil))
+			parts++
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return fmt.Sprintf("%x-%d", md5OfParts.Sum(nil), parts), nil
+}
+
+// verifyObject checks that the object at key has the same size and ETag as
+// the local file it was uploaded from.
+func verifyObject(bucket *s3gof3r.Bucket, key string, path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	partSize := bucket.Config.PartSize
+	if partSize < 5*1024*1024 {
+		partSize = 5 * 1024 * 1024
+	}
+	expectedETag, err := multipartETag(path, partSize)
+	if err != nil {
+		return err
+	}
+
+	resp, err := headObject(bucket, key)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return integrityError{key, "HEAD returned " + resp.Status}
+	}
+
+	size, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if size != fi.Size() {
+		return integrityError{key, fmt.Sprintf("size is %d, expected %d", size, fi.Size())}
+	}
+	etag := strings.Trim(resp.Header.Get("ETag"), `"`)
+	if etag != expectedETag {
+		return integrityError{key, fmt.Sprintf("ETag is %q, expected %q", etag, expectedETag)}
+	}
+	return nil
+}
+
+// headObject makes a signed HEAD request for key. The caller checks the
+// status.
+func headObject(bucket *s3gof3r.Bucket, key string) (*http.Response, error) {
+	req, err := http.NewRequest("HEAD", bucketObjectURL(bucket, key).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	bucket.Sign(req)
+	resp, err := bucket.Config.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// bucketObjectURL mirrors how s3gof3r addresses objects, for the requests it
+// has no method for.
+func bucketObjectURL(bucket *s3gof3r.Bucket, key string) *url.URL {
+	u := &url.URL{Scheme: bucket.Config.Scheme}
+	if strings.Contains(bucket.Name, ".") || bucket.Config.PathStyle {
+		u.Host = bucket.S3.Domain
+		u.Path = path.Clean("/" + bucket.Name + "/" + key)
+	} else {
+		u.Host = bucket.Name + "." + bucket.S3.Domain
+		u.Path = path.Clean("/" + key)
+	}
+	return u
+}
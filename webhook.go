@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/AndrewVos/ancientcitadelgifs/signature"
+)
+
+// webhookClient dials like downloadClient, so callbacks can't be pointed at
+// private addresses either, and checks every redirect the same way.
+var webhookClient = &http.Client{
+	Timeout: 30 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return checkCallbackURL(req.URL.String())
+	},
+	Transport: &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		Dial:                dialPublic,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+// checkCallbackURL refuses callbacks while WEBHOOK_SECRET is unset, since
+// they couldn't be signed, and urls that aren't http or https or are for a
+// private address. Hostnames that resolve to one are caught by dialPublic.
+func checkCallbackURL(callbackURL string) error {
+	if config.Webhook.Secret == "" {
+		return errors.New("callbacks are disabled, set WEBHOOK_SECRET to enable them")
+	}
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+		return errors.New(fmt.Sprintf("%q is not an http or https url", callbackURL))
+	}
+	if config.Source.AllowPrivate {
+		return nil
+	}
+	host := strings.ToLower(u.Hostname())
+	if ip := net.ParseIP(host); (ip != nil && isPrivateIP(ip)) || host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return errors.New(fmt.Sprintf("%q is a private address", callbackURL))
+	}
+	return nil
+}
+
+// deliverCallback POSTs the result of converting gifURL to callbackURL: the
+// UploadResult if it worked, or the JSONError if it didn't. The body is
+// signed with WEBHOOK_SECRET in the X-Signature header.
+func deliverCallback(log *logger, callbackURL string, gifURL string, uploadResult UploadResult, convertErr error) {
+	log = log.with("url", gifURL, "callback", callbackURL)
+	var body []byte
+	var err error
+	if convertErr != nil {
+		body, err = json.Marshal(JSONError{Error: convertErr.Error()})
+	} else {
+		body, err = json.Marshal(uploadResult)
+	}
+	if err != nil {
+		log.error("encoding callback failed", "error", err)
+		return
+	}
+
+	log.info("posting callback")
+	_, err = config.Webhook.Retry.do(log, func() error {
+		return postCallback(callbackURL, gifURL, body)
+	})
+	if _, ok := err.(drainedError); ok {
+		// The retries would outlast the grace period, so the callback is
+		// lost. Log it so it can be redelivered by hand.
+		log.error("callback not delivered, the server is shutting down", "error", err)
+	} else if err != nil {
+		log.error("giving up posting callback", "error", err)
+	}
+}
+
+func postCallback(callbackURL string, gifURL string, body []byte) error {
+	req, err := http.NewRequest("POST", callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Source-Url", gifURL)
+	req.Header.Set("X-Signature", signature.SignPayload([]byte(config.Webhook.Secret), body))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		if isTransientNetworkError(err) {
+			return retryable(err)
+		}
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	err = errors.New(fmt.Sprintf("%q returned %v", callbackURL, resp.Status))
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode == http.StatusRequestTimeout:
+		return retryable(err)
+	}
+	return err
+}